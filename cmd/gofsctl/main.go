@@ -0,0 +1,239 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"log"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"p4/ctl"
+	"p4/util"
+)
+
+/*
+=======================
+GOFSCTL
+=======================
+*/
+
+/* talks to a running replica over its control socket */
+
+var Usage = func() {
+	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "  %s [flags] COMMAND [ARGS]\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Commands:\n")
+	fmt.Fprintf(os.Stderr, "  status\n")
+	fmt.Fprintf(os.Stderr, "  peers\n")
+	fmt.Fprintf(os.Stderr, "  versions PATH\n")
+	fmt.Fprintf(os.Stderr, "  restore PATH VID [NEWPATH]\n")
+	fmt.Fprintf(os.Stderr, "  snapshot create NAME [PATH] | list | delete NAME\n")
+	fmt.Fprintf(os.Stderr, "  diff OLD NEW             (version ids or snapshot names)\n")
+	fmt.Fprintf(os.Stderr, "  gc\n")
+	fmt.Fprintf(os.Stderr, "  verify [PATH]\n")
+	fmt.Fprintf(os.Stderr, "  fsck [-repair]\n")
+	fmt.Fprintf(os.Stderr, "  log [LEVELS]             (e.g. info,network=debug)\n")
+	fmt.Fprintf(os.Stderr, "  pin PATH | unpin PATH | pins\n\n")
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = Usage
+	namePtr := flag.String("name", "auto", "replica to talk to, as named in config.txt")
+	socketPtr := flag.String("socket", "", "control socket of the replica (default: next to its database)")
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	socket := *socketPtr
+	if socket == "" {
+		util.SetConfigFile(*namePtr)
+		err, _, _, _, dbpath, _ := util.GetConfigDetailsFromName(*namePtr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		socket = ctl.SocketPath(dbpath)
+	}
+
+	req, err := parseCommand(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		flag.Usage()
+		os.Exit(2)
+	}
+	resp, err := ctl.Call(socket, req)
+	if err != nil {
+		log.Fatal(err)
+	}
+	printResponse(req, resp)
+}
+
+/* builds the request for a command line */
+func parseCommand(args []string) (ctl.Request, error) {
+	req := ctl.Request{}
+	arg := func(i int) string {
+		if i < len(args) {
+			return args[i]
+		}
+		return ""
+	}
+	need := func(n int) error {
+		if len(args) < n {
+			return fmt.Errorf("%s: missing arguments", strings.Join(args, " "))
+		}
+		return nil
+	}
+
+	switch args[0] {
+		case "status":
+			req.Op = ctl.OP_STATUS
+		case "peers":
+			req.Op = ctl.OP_PEERS
+		case "versions":
+			req.Op = ctl.OP_VERSIONS
+			req.Path = arg(1)
+			return req, need(2)
+		case "restore":
+			req.Op = ctl.OP_RESTORE
+			req.Path = arg(1)
+			req.Vid = arg(2)
+			req.Dest = arg(3)
+			return req, need(3)
+		case "snapshot":
+			switch arg(1) {
+				case "create":
+					req.Op = ctl.OP_SNAPSHOT_CREATE
+					req.Name = arg(2)
+					req.Path = arg(3)
+					return req, need(3)
+				case "list":
+					req.Op = ctl.OP_SNAPSHOT_LIST
+				case "delete":
+					req.Op = ctl.OP_SNAPSHOT_DELETE
+					req.Name = arg(2)
+					return req, need(3)
+				default:
+					return req, fmt.Errorf("unknown snapshot command %q", arg(1))
+			}
+		case "diff":
+			req.Op = ctl.OP_DIFF
+			req.Vid = arg(1)
+			req.OtherVid = arg(2)
+			return req, need(3)
+		case "gc":
+			req.Op = ctl.OP_GC
+		case "verify":
+			req.Op = ctl.OP_VERIFY
+			req.Path = arg(1)
+		case "fsck":
+			req.Op = ctl.OP_FSCK
+			req.Repair = arg(1) == "-repair"
+			if arg(1) != "" && !req.Repair {
+				return req, fmt.Errorf("unknown fsck option %q", arg(1))
+			}
+		case "log":
+			req.Op = ctl.OP_LOG
+			req.Levels = arg(1)
+		case "pin":
+			req.Op = ctl.OP_PIN
+			req.Path = arg(1)
+			return req, need(2)
+		case "unpin":
+			req.Op = ctl.OP_UNPIN
+			req.Path = arg(1)
+			return req, need(2)
+		case "pins":
+			req.Op = ctl.OP_PINS
+		default:
+			return req, fmt.Errorf("unknown command %q", args[0])
+	}
+	return req, nil
+}
+
+func printResponse(req ctl.Request, resp ctl.Response) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	defer w.Flush()
+
+	switch req.Op {
+		case ctl.OP_STATUS:
+			s := resp.Status
+			fmt.Fprintf(w, "name:\t%s (pid %d)\n", s.Name, s.Pid)
+			fmt.Fprintf(w, "address:\t%s over %s\n", s.Address, s.Transport)
+			fmt.Fprintf(w, "read-only:\t%v\n", s.ReadOnly)
+			fmt.Fprintf(w, "subscriptions:\t%s\n", strings.Join(s.Subscriptions, ", "))
+			fmt.Fprintf(w, "root version:\t%s\n", s.RootVid)
+			fmt.Fprintf(w, "update log:\t%s/%d\n", s.LogEpoch, s.LogSeq)
+			fmt.Fprintf(w, "members:\t%d\n", s.Members)
+			fmt.Fprintf(w, "pins:\t%d\n", s.Pins)
+			fmt.Fprintf(w, "snapshots:\t%d\n", s.Snapshots)
+		case ctl.OP_PEERS:
+			fmt.Fprintf(w, "PID\tNAME\tADDRESS\tSTATUS\tLAST SEEN\tRTT\n")
+			for _, p := range resp.Peers {
+				fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%v\n", p.Pid, p.Name, p.Address, p.Status, ago(p.LastSeen), p.RTT)
+			}
+		case ctl.OP_VERSIONS:
+			fmt.Fprintf(w, "VID\tWRITER\tSIZE\tMTIME\n")
+			for _, v := range resp.Versions {
+				fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", v.Vid, v.Writer, v.Size, v.Mtime.Format(time.RFC3339))
+			}
+		case ctl.OP_SNAPSHOT_LIST:
+			fmt.Fprintf(w, "NAME\tPATH\tCREATED\tVID\n")
+			for _, s := range resp.Snapshots {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", s.Name, s.Path, s.Created.Format(time.RFC3339), s.Vid)
+			}
+		case ctl.OP_DIFF:
+			for _, c := range resp.Changes {
+				fmt.Fprintln(w, c)
+			}
+		case ctl.OP_VERIFY:
+			v := resp.Verify
+			fmt.Fprintf(w, "%d chunks stored, %d corrupt, %d missing\n", v.Chunks, len(v.Corrupt), len(v.Missing))
+			for _, hash := range v.Corrupt {
+				fmt.Fprintf(w, "corrupt\t%s\n", hash)
+			}
+			for _, hash := range v.Missing {
+				fmt.Fprintf(w, "missing\t%s\n", hash)
+			}
+			if len(v.Corrupt) > 0 || len(v.Missing) > 0 {
+				w.Flush()
+				os.Exit(1)
+			}
+		case ctl.OP_FSCK:
+			f := resp.Fsck
+			fmt.Fprintf(w, "checked %d versions and %d chunks from %s, %d problems\n", f.Nodes, f.Chunks, f.RootVid, len(f.Problems))
+			for _, p := range f.Problems {
+				fmt.Fprintln(w, p)
+			}
+			if !f.Clean {
+				w.Flush()
+				os.Exit(1)
+			}
+		case ctl.OP_LOG:
+			for _, l := range resp.LogLevels {
+				fmt.Fprintln(w, l)
+			}
+		case ctl.OP_PINS:
+			fmt.Fprintf(w, "PATH\tSYNCED\tLAST SYNC\n")
+			for _, p := range resp.Pins {
+				fmt.Fprintf(w, "%s\t%d/%d\t%s\n", p.Path, p.Synced, p.Chunks, ago(p.LastSync))
+			}
+		default:
+			if resp.Message != "" {
+				fmt.Fprintln(w, resp.Message)
+			} else {
+				fmt.Fprintln(w, "ok")
+			}
+	}
+}
+
+func ago(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return time.Since(t).Truncate(time.Second).String() + " ago"
+}
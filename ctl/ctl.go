@@ -0,0 +1,187 @@
+package ctl
+
+import (
+	"net"
+	"os"
+	"time"
+	"errors"
+	"encoding/json"
+)
+
+/*
+======================
+CONTROL PROTOCOL
+=======================
+*/
+
+/*
+	A running replica listens on a unix socket next to its database for gofsctl. Every
+	connection carries one JSON Request and one JSON Response. This package only holds the
+	protocol, so tools can talk to a replica without pulling in FUSE or the filesystem.
+*/
+
+const (
+	OP_STATUS = "status"
+	OP_PEERS = "peers"
+	OP_VERSIONS = "versions"
+	OP_RESTORE = "restore"
+	OP_SNAPSHOT_CREATE = "snapshot-create"
+	OP_SNAPSHOT_LIST = "snapshot-list"
+	OP_SNAPSHOT_DELETE = "snapshot-delete"
+	OP_DIFF = "diff"
+	OP_GC = "gc"
+	OP_VERIFY = "verify"
+	OP_PIN = "pin"
+	OP_UNPIN = "unpin"
+	OP_PINS = "pins"
+	OP_FSCK = "fsck"
+	OP_LOG = "log"
+)
+
+/* how long gofsctl waits on a replica. restores and pins may have to fetch from peers */
+const CALL_TIMEOUT = 5 * time.Minute
+
+type Request struct {
+	Op string
+	Path string
+	Vid string		/* version id or snapshot name */
+	OtherVid string	/* second version of a diff */
+	Dest string		/* restore to a new path */
+	Name string		/* snapshot name */
+	Repair bool		/* fsck: fetch what is missing or damaged from the peers */
+	Levels string	/* log levels to set, e.g. "info,network=debug". empty only reports them */
+}
+
+type Response struct {
+	Error string
+
+	Status Status
+	Peers []Peer
+	Versions []Version
+	Snapshots []Snapshot
+	Changes []string
+	Pins []Pin
+	Verify Verify
+	Fsck Fsck
+	LogLevels []string
+
+	/* anything else worth telling, e.g. how many chunks gc dropped */
+	Message string
+}
+
+type Status struct {
+	Name string
+	Pid int
+	Address string
+	Transport string
+	ReadOnly bool
+	Subscriptions []string
+	RootVid string
+	LogEpoch string
+	LogSeq uint64
+	Members int
+	Pins int
+	Snapshots int
+}
+
+type Peer struct {
+	Pid int
+	Name string
+	Address string
+	Status string
+	LastSeen time.Time
+	RTT time.Duration
+}
+
+type Version struct {
+	Vid string
+	Writer string
+	Size uint64
+	Mtime time.Time
+}
+
+type Snapshot struct {
+	Name string
+	Path string
+	Vid string
+	Created time.Time
+}
+
+type Pin struct {
+	Path string
+	Created time.Time
+	LastSync time.Time
+	Chunks int
+	Synced int
+}
+
+type Verify struct {
+	Chunks int
+	Corrupt []string
+	Missing []string
+}
+
+type Fsck struct {
+	RootVid string
+	Nodes int
+	Chunks int
+	Problems []string
+	Clean bool
+}
+
+/* the control socket of the replica whose database is at dbpath */
+func SocketPath(dbpath string) string {
+	return dbpath + ".ctl"
+}
+
+/* serves requests on a unix socket at path until the returned listener is closed */
+func Serve(path string, handle func(Request) Response) (net.Listener, error) {
+	/* a replica that died leaves its socket behind */
+	os.Remove(path)
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	os.Chmod(path, 0600)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveConn(conn, handle)
+		}
+	}()
+	return l, nil
+}
+
+func serveConn(conn net.Conn, handle func(Request) Response) {
+	defer conn.Close()
+	var req Request
+	if err := json.NewDecoder(conn).Decode(&req); err != nil {
+		json.NewEncoder(conn).Encode(Response{Error: err.Error()})
+		return
+	}
+	json.NewEncoder(conn).Encode(handle(req))
+}
+
+/* sends a request to the replica listening at path */
+func Call(path string, req Request) (Response, error) {
+	var resp Response
+	conn, err := net.DialTimeout("unix", path, 5 * time.Second)
+	if err != nil {
+		return resp, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(CALL_TIMEOUT))
+	if err = json.NewEncoder(conn).Encode(req); err != nil {
+		return resp, err
+	}
+	if err = json.NewDecoder(conn).Decode(&resp); err != nil {
+		return resp, err
+	}
+	if resp.Error != "" {
+		return resp, errors.New(resp.Error)
+	}
+	return resp, nil
+}
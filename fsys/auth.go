@@ -0,0 +1,114 @@
+package fsys
+
+import (
+	"errors"
+	"strings"
+	"io/ioutil"
+	"p4/util"
+	"p4/transport"
+)
+
+/*
+======================
+AUTHENTICATION
+=======================
+*/
+
+/*
+	When a replica is started with a key file, the transport authenticates every connection
+	(CurveZMQ with the zmq transport): bound sockets only accept clients whose public key belongs
+	to a member, and connecting sockets check that the server holds the secret key matching the
+	member's public key. Public keys come from the 7th column of config.txt and travel with the
+	member list, so a replica joining at runtime must be listed in its seed's config.txt.
+	Requests must come with the key of the member they claim to be from, and broadcasts from
+	the address of that member, whose publisher proved it holds the member's key. Only the zmq
+	transport authenticates; with a key file, the others refuse to start. Without a key file
+	nothing is authenticated, as before.
+*/
+
+var curvePublic string
+var curveSecret string
+
+func authEnabled() bool {
+	return curveSecret != ""
+}
+
+/* generates a new key pair for the config file and a key file */
+func GenerateKeyPair() (public string, secret string, err error) {
+	return transport.GenerateKeyPair()
+}
+
+/* reads the secret key of this replica and checks it against the public key in the config */
+func LoadKeyFile(keyfile string) error {
+	keystr, err := ioutil.ReadFile(keyfile)
+	if err != nil {
+		return err
+	}
+	secret := strings.TrimSpace(string(keystr))
+	public, err := transport.PublicKeyFor(secret)
+	if err != nil {
+		return err
+	}
+	if self, _ := GetMember(Pid); self.PublicKey != public {
+		return errors.New("key file does not match the public key configured for " + ServerName)
+	}
+	curvePublic = public
+	curveSecret = secret
+	return nil
+}
+
+/* lets a member through, or shuts it out once it left */
+func allowMember(m Member) {
+	if Net == nil || !authEnabled() || m.PublicKey == "" {
+		return
+	}
+	Net.Allow(m.PublicKey, !m.Left)
+}
+
+/* public key of the member serving at addr (its PUB or REP socket), falling back on the config file for replicas not known yet */
+func serverKeyOf(addr string) string {
+	for _, m := range GetAllMembers() {
+		if m.Address.String() == addr || m.Address.RepEndpoint().String() == addr {
+			return m.PublicKey
+		}
+	}
+	for _, e := range util.ReadAllConfigEntries() {
+		if e.HostAddress.String() == addr || e.HostAddress.RepEndpoint().String() == addr {
+			return e.PublicKey
+		}
+	}
+	return ""
+}
+
+/* checks that a broadcast claiming to come from msg.From was published by that member, at addr */
+func authorizeBroadcast(msg Message, addr string) bool {
+	if !authEnabled() {
+		return true
+	}
+	if m, found := GetMember(msg.From); !found || m.Address.String() != addr {
+		netLog.Warn("dropping broadcast, not published by its sender", "type", msg.Type, "peer", msg.From, "addr", addr)
+		return false
+	}
+	return true
+}
+
+/* checks that a request claiming to come from msg.From was sent with that member's key */
+func authorizeRequest(msg Message, key string) bool {
+	if !authEnabled() {
+		return true
+	}
+	m, found := GetMember(msg.From)
+	if found && m.PublicKey != key {
+		netLog.Warn("rejecting request, key does not match", "type", msg.Type, "peer", msg.From, "key", key)
+		return false
+	}
+	if !found || m.Left {
+		/* only a (re)joining replica may talk to us without being a current member */
+		joining := msg.Type == JOIN_REQUEST && len(msg.Members) == 1 && msg.Members[0].Pid == msg.From && msg.Members[0].PublicKey == key
+		if !joining {
+			netLog.Warn("rejecting request, not a member", "type", msg.Type, "peer", msg.From)
+		}
+		return joining
+	}
+	return true
+}
@@ -0,0 +1,164 @@
+package fsys
+
+import (
+	"sync"
+	"container/list"
+	"p4/trace"
+)
+
+/*
+======================
+NODE CACHE
+=======================
+*/
+
+/*
+	Expanded nodes hold their children or their file's data in memory. They are kept in LRU
+	order, and once there are more than CacheMaxNodes of them or they hold more than
+	CacheMaxBytes, the least recently used clean ones are collapsed back to what their version
+	record says (expanded = false), to be loaded again from the store when next used. Dirty
+	nodes, the root and archives (whose children aren't in any version record) are never
+	collapsed, and neither is a directory with expanded children: the children go first.
+	Collapsing happens under lock.LOCK, which every FUSE op holds while it reads a node's
+	children or data, Lookup and Attr included.
+*/
+
+/* limits of the cache, 0 for no limit. set by -cachemb and -cachenodes */
+var CacheMaxBytes int64 = 256 << 20
+var CacheMaxNodes int = 100000
+
+/* rough footprint of a loaded node and its stubs, data aside */
+const NODE_BYTES int64 = 512
+
+type cacheEntry struct {
+	node *MyNode
+	bytes int64
+}
+
+/* most recently used first. protected by cacheLock */
+var nodeCache struct {
+	lru *list.List
+	entries map[*MyNode]*list.Element
+	bytes int64
+}
+var cacheLock sync.Mutex
+
+func init() {
+	nodeCache.lru = list.New()
+	nodeCache.entries = make(map[*MyNode]*list.Element)
+}
+
+func nodeBytes(n *MyNode) int64 {
+	return NODE_BYTES * int64(len(n.children) + 1) + int64(cap(n.data))
+}
+
+/* marks an expanded node as just used, and accounts for what it holds now */
+func touchNode(n *MyNode) {
+	if !n.expanded {
+		return
+	}
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+	e, found := nodeCache.entries[n]
+	if !found {
+		e = nodeCache.lru.PushFront(&cacheEntry{node: n})
+		nodeCache.entries[n] = e
+	} else {
+		nodeCache.lru.MoveToFront(e)
+	}
+	entry := e.Value.(*cacheEntry)
+	size := nodeBytes(n)
+	nodeCache.bytes += size - entry.bytes
+	entry.bytes = size
+}
+
+func overCacheLimits() bool {
+	return (CacheMaxBytes > 0 && nodeCache.bytes > CacheMaxBytes) || (CacheMaxNodes > 0 && nodeCache.lru.Len() > CacheMaxNodes)
+}
+
+func collapsible(n *MyNode) bool {
+	if n.dirty || n.parent == nil || n.archive || !n.expanded {
+		return false
+	}
+	for _, c := range n.children {
+		if c.expanded {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+	Collapses least recently used nodes until the cache is within its limits. The most
+	recently used node is always kept, however big. Caller holds lock.LOCK.
+*/
+func evictNodes() {
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+	for e := nodeCache.lru.Back(); e != nil && e != nodeCache.lru.Front() && overCacheLimits(); {
+		prev := e.Prev()
+		entry := e.Value.(*cacheEntry)
+		n := entry.node
+		if !n.expanded {
+			/* collapsed by an update from a peer */
+			nodeCache.lru.Remove(e)
+			delete(nodeCache.entries, n)
+			nodeCache.bytes -= entry.bytes
+		} else if collapsible(n) {
+			kind := "file"
+			if n.Attrib.Mode.IsDir() {
+				kind = "dir"
+			}
+			storeLog.Debug("collapsed", "node", n.Name, "vid", n.Vid, "kind", kind, "bytes", entry.bytes)
+			n.children = make(map[string]*MyNode)
+			n.data = nil
+			n.expanded = false
+			nodeCache.lru.Remove(e)
+			delete(nodeCache.entries, n)
+			nodeCache.bytes -= entry.bytes
+			cacheEvictions.Inc(kind)
+		}
+		e = prev
+	}
+	cachedNodes.Set(float64(nodeCache.lru.Len()))
+	cachedBytes.Set(float64(nodeCache.bytes))
+}
+
+/*
+	Puts a node that is being changed back among its parent's children. The kernel holds on to
+	nodes, so a file can be written to after its directory was collapsed and loaded again with
+	new nodes; the changes would be lost when the directory is written back. Nodes that were
+	removed or renamed away no longer have a stub in the parent under their name and are left
+	alone. Caller holds lock.LOCK.
+*/
+func reattach(n *MyNode) {
+	p := n.parent
+	if p == nil {
+		return
+	}
+	if stub, found := p.Kids[n.Name]; !found || stub.NodeID != n.NodeID {
+		return
+	}
+	if err := AssertExpanded(trace.None, p); err != nil {
+		storeLog.Warn("could not reattach a node to its directory", "node", n.Name, "dir", p.Name, "err", err)
+		return
+	}
+	if p.children[n.Name] != n {
+		storeLog.Debug("reattached", "node", n.Name, "dir", p.Name)
+		p.children[n.Name] = n
+	}
+}
+
+/* collapses a node no one can reach any more and stops accounting for it. caller holds lock.LOCK */
+func dropNode(n *MyNode) {
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+	if e, found := nodeCache.entries[n]; found {
+		nodeCache.bytes -= e.Value.(*cacheEntry).bytes
+		nodeCache.lru.Remove(e)
+		delete(nodeCache.entries, n)
+	}
+	n.children = make(map[string]*MyNode)
+	n.data = nil
+	n.expanded = false
+}
@@ -5,8 +5,9 @@ import (
 	"encoding/json"
 	"os"
 	"p4/storage"
-	"p4/util"
-	"math/rand"
+	"hash/fnv"
+	"encoding/binary"
+	"p4/trace"
 )
 
 /* namespaces for the data store */
@@ -15,61 +16,122 @@ const NODE_VERSION_KEY string = "NDV"
 const NODE_VERSION_LIST string = "NDVL"
 const STATE_KEY = "STATE"
 
+/* versions received from peers that haven't been applied to the in-memory tree yet, by path */
 var hash2mynode map[string]MyNode
 
 
 /* a structure to store State */
 type STATE struct {
 	Root_version_bootstrap string	/* latest root version */
-	NextInode uint64			/* next available inode number */
-	NextNId int					/* next available node id */
+	NextNId int					/* counter of the node ids this replica handed out */
 }
 
 /* important variables */
 var State STATE
 
-func LoadState() {
-	statestr, _ := storage.Get([]byte(STATE_KEY))
-	json.Unmarshal(statestr, &State)
-	State.NextInode++
+func LoadState() error {
+	statestr, err := storage.Get([]byte(STATE_KEY))
+	if err == nil {
+		if err = json.Unmarshal(statestr, &State); err != nil {
+			return fmt.Errorf("state: %v: %w", err, ErrCorrupt)
+		}
+	}
+	/* no state yet means a new filesystem */
+	return nil
 }
 
 /* places an fs object in the memory pointed to by the argument */
-func LoadFS(fs *MyFS) {
+func LoadFS(fs *MyFS) error {
 
 	hash2mynode = make(map[string]MyNode)
 
 	/* State.Root_version_bootstrap is Vid of root of filesystem */
 	str := fmt.Sprintf("%s:%s", NODE_VERSION_KEY, State.Root_version_bootstrap)
-	util.P_out("key: %s", str)
 	rootdirstr, err := storage.Get([]byte(str))
 	if err != nil {
-		util.P_out("creating filesystem!")
+		storeLog.Info("creating filesystem")
 		/* key most likely doesn't exist */
 		fs.RootDir = new(MyNode)
 		fs.RootDir.Init("/", os.ModeDir | 0755, nil)
+		fs.RootDir.NodeID = ROOT_NODEID
+		fs.RootDir.Attrib.Inode = nodeInode(ROOT_NODEID)
 		fs.RootDir.Vid = GenerateVersionId(fs.RootDir)
 		updateAncestors(fs.RootDir)
 	} else {
-		util.P_out("loading filesystem!")
-		json.Unmarshal(rootdirstr, &fs.RootDir)
+		storeLog.Info("loading filesystem", "vid", State.Root_version_bootstrap)
+		if err = json.Unmarshal(rootdirstr, &fs.RootDir); err != nil {
+			return fmt.Errorf("root version %s: %v: %w", State.Root_version_bootstrap, err, ErrCorrupt)
+		}
+	}
+	/* if some of it can't be loaded right now, it is tried again when it's looked at */
+	if err = AssertExpanded(trace.None, fs.RootDir); err != nil {
+		storeLog.Warn("root not loaded yet", "err", err)
 	}
-	AssertExpanded(fs.RootDir)
+	return nil
+}
+
+/*
+	Inodes are derived rather than handed out, so a file keeps its inode across restarts,
+	renames and new versions, and has the same one on every replica. Old versions shown
+	read-only (snapshots, history entries, archives) share their node id with the live file,
+	so they get one derived from the version id instead, in the upper half of the range. The
+	directories that hold them (/.snapshots, name.history, name@date) have no version of their
+	own; theirs is derived from the parent's inode and their name.
+*/
+func nodeInode(nodeID int) uint64 {
+	return uint64(nodeID)
+}
 
-	rand.Seed(int64(Pid))
+func versionInode(vid string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(vid))
+	return h.Sum64() | 1 << 63
 }
 
-/* self explanatory */
-func GetAvailableInode() uint64 {
-	return uint64(rand.Int63())
-	State.NextInode++
-	return State.NextInode
+func childInode(parent uint64, name string) uint64 {
+	h := fnv.New64a()
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], parent)
+	h.Write(buf[:])
+	h.Write([]byte(name))
+	return h.Sum64() | 1 << 63
 }
 
+/* the inode of a node as the kernel sees it */
+func (n *MyNode) inode() uint64 {
+	for current := n; current != nil; current = current.parent {
+		if !current.archive {
+			continue
+		}
+		if n.Vid == "" && n.parent != nil {
+			return childInode(n.parent.inode(), n.Name)
+		}
+		return versionInode(n.Vid)
+	}
+	return nodeInode(n.NodeID)
+}
+
+
+/*
+	Node ids are (pid, counter) pairs: the pid of the replica that created the node above
+	NODEID_PID_SHIFT bits of that replica's own counter, so no two replicas hand out the same
+	id. Ids below 1 << NODEID_PID_SHIFT were handed out before, when every replica counted
+	from 1 on its own; upgrading the store gives them their creator's pid too (see
+	prefixLegacyNodeIds), so only the root's is left. Node ids are 64 bits wide: gofs needs a
+	64 bit platform.
+*/
+const NODEID_PID_SHIFT uint = 40
+
+/* the root is the same node on every replica */
+const ROOT_NODEID int = 1
+
+func makeNodeID(pid int, counter int) int {
+	return pid << NODEID_PID_SHIFT | counter
+}
 
 func GetAvailableUid() int {
 	State.NextNId++
-	return State.NextNId
+	return makeNodeID(GetMyPid(), State.NextNId)
 }
 
 
@@ -82,70 +144,91 @@ func SaveNodeVersion(node *MyNode) bool {
 	return true
 }
 
-/* load node */
-func LoadNodeVersion(Vid string, lastWriter int) (*MyNode, error) {
+/* load node. fetches it from the peers if it isn't stored here, even if I wrote it: someone may have a copy */
+func LoadNodeVersion(parent trace.SpanContext, Vid string, lastWriter int) (*MyNode, error) {
 	var x MyNode
 	/* first check if I have it */
 	nodestr, err := storage.Get([]byte(fmt.Sprintf("%s:%v", NODE_VERSION_KEY, Vid)))
 	if err != nil {
-		/* if I don't and I'm the last writer, panic. Otherwise fetch it */
 		if lastWriter == GetMyPid() {
-			panic("I wrote last but I still dont have the metadata! I have an idea: lets abort!")
-		} else {
-			dest := util.GetEndpointFromPid(lastWriter)
-			completeNode := PerformMetaDataRequest(Vid, dest.RepTcpFormat())
-			str, _ := json.Marshal(&completeNode)
-			storage.Put([]byte(fmt.Sprintf("%s:%v", NODE_VERSION_KEY, Vid)), str)
-			return &completeNode, nil
+			storeLog.Warn("lost a version I wrote, asking around", "vid", Vid)
+		}
+		completeNode, err := PerformMetaDataRequest(parent, Vid, lastWriter)
+		if err != nil {
+			return nil, err
 		}
+		str, _ := json.Marshal(&completeNode)
+		storage.Put([]byte(fmt.Sprintf("%s:%v", NODE_VERSION_KEY, Vid)), str)
+		return &completeNode, nil
 	}
-	json.Unmarshal(nodestr, &x)
-	return &x, err
+	if err = json.Unmarshal(nodestr, &x); err != nil {
+		return nil, fmt.Errorf("version %s: %v: %w", Vid, err, ErrCorrupt)
+	}
+	return &x, nil
 }
 
-/* load data */
-func loadDataChunk(hash string, lastWriter int) ([]byte, error) {
+/* load data. fetches it from the peers if it isn't stored here, like LoadNodeVersion */
+func loadDataChunk(parent trace.SpanContext, hash string, lastWriter int, path string) ([]byte, error) {
 	ret, err := storage.Get([]byte(fmt.Sprintf("%s:%v", DATA_KEY, hash)))
 	if err != nil {
+		chunkLoads.Inc("miss")
 		if lastWriter == GetMyPid() {
-			panic("I wrote last but I still dont have the data! I have an idea: lets abort!")
-		} else {
-			dest := util.GetEndpointFromPid(lastWriter)
-			dataSlices := PerformDataRequest(hash, dest.RepTcpFormat())
-			storage.Put([]byte(fmt.Sprintf("%s:%v", DATA_KEY, hash)), dataSlices)
-			return dataSlices, nil
+			storeLog.Warn("lost a chunk I wrote, asking around", "chunk", hash)
+		}
+		dataSlices, err := PerformDataRequest(parent, hash, lastWriter)
+		if err != nil {
+			return nil, err
 		}
+		storage.Put([]byte(fmt.Sprintf("%s:%v", DATA_KEY, hash)), dataSlices)
+		if lastWriter != GetMyPid() {
+			markCached(hash, path)
+		}
+		return dataSlices, nil
 	}
+	chunkLoads.Inc("hit")
 	return ret, nil
 }
 
 
-/* expands this node and loads its children (if it hasn't already been done) */
-func AssertExpanded(node *MyNode) {
+/* expands this node and loads its children (if it hasn't already been done). on error the node is left as it was, and expanding is tried again next time */
+func AssertExpanded(parent trace.SpanContext, node *MyNode) error {
 	if !node.expanded {
+		span := trace.Start(parent, "AssertExpanded", "node", node.Name, "vid", node.Vid)
+		defer span.End()
 		/* dirty, children, data */
 		//node.dirty = false;
 		if(node.Attrib.Mode.IsDir()) {
 			/* children, not data */
-			util.P_out("%s children are:", node.Name)
-			node.children = make(map[string]*MyNode)
+			children := make(map[string]*MyNode)
 			for name, childStubs := range node.Kids {
-				node.children[name], _ = LoadNodeVersion(childStubs.Vid, childStubs.LastWriter)
-				node.children[name].parent = node
-				util.P_out("%v", node.children[name])
+				child, err := LoadNodeVersion(span.Context(), childStubs.Vid, childStubs.LastWriter)
+				if err != nil {
+					span.SetError(err)
+					return err
+				}
+				child.parent = node
+				children[name] = child
+				storeLog.Debug("loaded child", "node", node.Name, "child", child.Name, "vid", child.Vid)
 			}
+			node.children = children
 		} else {
 			/* data, not children */
-			node.data = []byte{}
+			data := []byte{}
+			path := nodePath(node)
 			for i := 0; i < len(node.DataBlocks); i++ {
-				loadedData, _ := loadDataChunk(node.DataBlocks[i], node.LastWriter)
-				for j := 0; j < len(loadedData); j++ {
-					node.data = append(node.data, loadedData[j])
+				loadedData, err := loadDataChunk(span.Context(), node.DataBlocks[i], node.LastWriter, path)
+				if err != nil {
+					span.SetError(err)
+					return err
 				}
+				data = append(data, loadedData...)
 			}
+			node.data = data
 		}
 		node.expanded = true
 	}
+	touchNode(node)
+	return nil
 }
 
 
@@ -158,8 +241,17 @@ func RegisterNodeVersion(nodeID int, versionID string) {
 		storage.Put(key, []byte(valstr))
 	} else {
 		var existingList []string
-		json.Unmarshal(existingListStr, &existingList)
+		if err = json.Unmarshal(existingListStr, &existingList); err != nil {
+			/* start over rather than lose the new version too */
+			storeLog.Error("corrupt version list", "nodeid", nodeID, "err", err)
+		}
 
+		/* versions from peers may be merged more than once */
+		for _, v := range existingList {
+			if v == versionID {
+				return
+			}
+		}
 		existingList = append(existingList, versionID)
 		newListStr, _ := json.Marshal(existingList)
 		storage.Put(key, newListStr)
@@ -173,7 +265,10 @@ func GetNodeVersions(nodeID int) []string {
 		return []string{}
 	} else {
 		var versionList []string
-		json.Unmarshal(lstr, &versionList)
+		if err = json.Unmarshal(lstr, &versionList); err != nil {
+			storeLog.Error("corrupt version list", "nodeid", nodeID, "err", err)
+			return []string{}
+		}
 		return versionList
 	}
 }
@@ -181,18 +276,22 @@ func GetNodeVersions(nodeID int) []string {
 
 
 
-func Merge(versions map[string]MyNode, fs *MyFS) {
-	/* create a map from Vid (hash) to corresponding node */
+func Merge(parent trace.SpanContext, versions map[string]MyNode, fs *MyFS) {
+	span := trace.Start(parent, "Merge", "versions", fmt.Sprintf("%d", len(versions)))
+	defer span.End()
+	/* create a map from path to corresponding node */
 	for k := range versions {
 		hash2mynode[k] = versions[k]
 		temp := versions[k]
 		nodestr, _ := json.Marshal(&temp)
 		storage.Put([]byte(fmt.Sprintf("%s:%v", NODE_VERSION_KEY, versions[k].Vid)), nodestr)
+		/* so the history (and restore) covers versions written elsewhere */
+		RegisterNodeVersion(temp.NodeID, temp.Vid)
 	}
 	general, _ := fs.Root()
 	r := general.(*MyNode)
 
-	val, found := hash2mynode[r.Vid]
+	val, found := hash2mynode[nodePath(r)]
 	if found {
 		State.Root_version_bootstrap = val.Vid
 		statestr, _ := json.Marshal(State)
@@ -0,0 +1,125 @@
+package fsys
+
+import (
+	"net"
+	"fmt"
+	pathpkg "path"
+	"p4/ctl"
+	"p4/util"
+)
+
+/*
+======================
+CONTROL SOCKET
+=======================
+*/
+
+/* the control socket, closed by Close */
+var ctlListener net.Listener
+
+/* serves gofsctl on a unix socket (see ctl.SocketPath) */
+func StartControl(path string, fs *MyFS) error {
+	var err error
+	ctlListener, err = ctl.Serve(path, func(req ctl.Request) ctl.Response {
+		return handleControl(req, fs)
+	})
+	if err == nil {
+		storeLog.Info("control socket", "path", path)
+	}
+	return err
+}
+
+func handleControl(req ctl.Request, fs *MyFS) ctl.Response {
+	storeLog.Debug("control request", "op", req.Op, "path", req.Path)
+	resp := ctl.Response{}
+	path := "/"
+	if req.Path != "" {
+		path = pathpkg.Clean("/" + req.Path)
+	}
+
+	var err error
+	if req.Op == ctl.OP_STATUS {
+		resp.Status = controlStatus()
+	} else if req.Op == ctl.OP_PEERS {
+		for _, h := range GetPeerHealth() {
+			m, _ := GetMember(h.Pid)
+			resp.Peers = append(resp.Peers, ctl.Peer{Pid: h.Pid, Name: h.Name, Address: m.Address.String(), Status: h.Status.String(), LastSeen: h.LastSeen, RTT: h.RTT})
+		}
+	} else if req.Op == ctl.OP_VERSIONS {
+		var versions []*MyNode
+		versions, err = GetVersions(fs, path)
+		for _, v := range versions {
+			resp.Versions = append(resp.Versions, ctl.Version{Vid: v.Vid, Writer: writerName(v.LastWriter), Size: v.Attrib.Size, Mtime: v.Attrib.Mtime})
+		}
+	} else if req.Op == ctl.OP_RESTORE {
+		err = RestoreVersion(fs, path, req.Vid, req.Dest)
+	} else if req.Op == ctl.OP_SNAPSHOT_CREATE {
+		var snap Snapshot
+		snap, err = CreateSnapshot(fs, req.Name, path)
+		resp.Message = snap.String()
+	} else if req.Op == ctl.OP_SNAPSHOT_LIST {
+		for _, s := range GetSnapshots() {
+			resp.Snapshots = append(resp.Snapshots, ctl.Snapshot{Name: s.Name, Path: s.Path, Vid: s.Vid, Created: s.Created})
+		}
+	} else if req.Op == ctl.OP_SNAPSHOT_DELETE {
+		err = DeleteSnapshot(req.Name)
+	} else if req.Op == ctl.OP_DIFF {
+		var changes []Change
+		changes, err = Diff(ResolveVersion(req.Vid), ResolveVersion(req.OtherVid))
+		for _, c := range changes {
+			resp.Changes = append(resp.Changes, c.String())
+		}
+	} else if req.Op == ctl.OP_GC {
+		resp.Message = fmt.Sprintf("dropped %d chunks", CollectGarbage(fs))
+	} else if req.Op == ctl.OP_VERIFY {
+		var res VerifyResult
+		res, err = VerifyChunks(fs, path)
+		resp.Verify = ctl.Verify{Chunks: res.Chunks, Corrupt: res.Corrupt, Missing: res.Missing}
+	} else if req.Op == ctl.OP_FSCK && req.Repair && ReadOnly {
+		err = ErrReadOnly
+	} else if req.Op == ctl.OP_FSCK {
+		report := FsckOnline(fs, req.Repair)
+		resp.Fsck = ctl.Fsck{RootVid: report.RootVid, Nodes: report.Nodes, Chunks: report.Chunks, Clean: report.Clean()}
+		for _, p := range report.Problems {
+			resp.Fsck.Problems = append(resp.Fsck.Problems, p.String())
+		}
+	} else if req.Op == ctl.OP_PIN {
+		err = PinPath(path)
+	} else if req.Op == ctl.OP_UNPIN {
+		err = UnpinPath(path)
+	} else if req.Op == ctl.OP_PINS {
+		for _, p := range GetPins() {
+			resp.Pins = append(resp.Pins, ctl.Pin{Path: p.Path, Created: p.Created, LastSync: p.LastSync, Chunks: p.Chunks, Synced: p.Synced})
+		}
+	} else if req.Op == ctl.OP_LOG {
+		if req.Levels != "" {
+			err = util.SetLogLevels(req.Levels)
+		}
+		resp.LogLevels = util.LogLevels()
+	} else {
+		err = fmt.Errorf("unknown operation %q", req.Op)
+	}
+
+	if err != nil {
+		resp.Error = err.Error()
+	}
+	return resp
+}
+
+func controlStatus() ctl.Status {
+	head := GetLogHead()
+	return ctl.Status{
+		Name: ServerName,
+		Pid: Pid,
+		Address: HostAddress.String(),
+		Transport: TransportName,
+		ReadOnly: ReadOnly,
+		Subscriptions: Subscriptions,
+		RootVid: State.Root_version_bootstrap,
+		LogEpoch: head.Epoch,
+		LogSeq: head.Seq,
+		Members: len(GetAllMembers()),
+		Pins: len(GetPins()),
+		Snapshots: len(GetSnapshots()),
+	}
+}
@@ -0,0 +1,315 @@
+package fsys
+
+import (
+	"fmt"
+	"sort"
+	"errors"
+	"strings"
+	"p4/trace"
+	pathpkg "path"
+)
+
+/*
+======================
+DIFF
+=======================
+*/
+
+/*
+	Compares two versions of a tree: two root versions (e.g. two snapshots), or two versions of
+	one directory or file. Both trees are walked together by name and subtrees with the same
+	version id are skipped, since their contents are the same. What is left on only one side is
+	matched up by NodeID, which survives renames and moves, so a moved file shows up as renamed
+	(and modified, if it also changed) instead of as removed plus added. Data changes are
+	reported per chunk: the byte ranges of the new version made of chunks the old one doesn't
+	have, and the other way round. Changes to a node's own attributes (its mode, owner and
+	replication factor) are reported too, for directories as well as files.
+
+	A version that can't be loaded, here or from a peer, fails the whole diff rather than
+	leaving the subtree out, since an incomplete diff would look like a complete one.
+*/
+
+type ChangeKind int
+
+const (
+	CHANGE_ADDED ChangeKind = iota
+	CHANGE_REMOVED
+	CHANGE_MODIFIED
+	CHANGE_RENAMED
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+		case CHANGE_ADDED:
+			return "added"
+		case CHANGE_REMOVED:
+			return "removed"
+		case CHANGE_MODIFIED:
+			return "modified"
+	}
+	return "renamed"
+}
+
+type ByteRange struct {
+	Offset int
+	Length int
+}
+
+type Change struct {
+	Kind ChangeKind
+	Path string
+	OldPath string		/* renamed only */
+	NodeID int
+	Dir bool
+
+	/* files only: ranges of the new version not in the old one, and of the old version not in the new one */
+	Changed []ByteRange
+	Removed []ByteRange
+
+	/* modified only: the node's own attributes that changed, e.g. "mode drwxr-xr-x -> drwx------" */
+	Attrs []string
+}
+
+func (c Change) String() string {
+	s := fmt.Sprintf("%-8s %s", c.Kind, c.Path)
+	if c.Kind == CHANGE_RENAMED {
+		s = fmt.Sprintf("%-8s %s -> %s", c.Kind, c.OldPath, c.Path)
+	}
+	for _, r := range c.Changed {
+		s += fmt.Sprintf(" +[%d,%d)", r.Offset, r.Offset + r.Length)
+	}
+	for _, r := range c.Removed {
+		s += fmt.Sprintf(" -[%d,%d)", r.Offset, r.Offset + r.Length)
+	}
+	if len(c.Attrs) > 0 {
+		s += " (" + strings.Join(c.Attrs, ", ") + ")"
+	}
+	return s
+}
+
+/* a node found on one side only */
+type diffEntry struct {
+	path string
+	node *MyNode
+	parentID int
+	top bool	/* its parent is on both sides */
+}
+
+type differ struct {
+	changes []Change
+	oldOnly map[int]diffEntry
+	newOnly map[int]diffEntry
+}
+
+/* a snapshot name, or else a version id */
+func ResolveVersion(spec string) string {
+	if snap, found := GetSnapshot(spec); found {
+		return snap.Vid
+	}
+	return spec
+}
+
+/* changes from version oldVid to version newVid, by path */
+func Diff(oldVid string, newVid string) ([]Change, error) {
+	oldNode, err := LoadNodeVersion(trace.None, oldVid, -1)
+	if err != nil {
+		return nil, err
+	}
+	if oldNode.Vid != oldVid {
+		return nil, fmt.Errorf("version %s: %w", oldVid, ErrVersionMissing)
+	}
+	newNode, err := LoadNodeVersion(trace.None, newVid, -1)
+	if err != nil {
+		return nil, err
+	}
+	if newNode.Vid != newVid {
+		return nil, fmt.Errorf("version %s: %w", newVid, ErrVersionMissing)
+	}
+	if oldNode.Attrib.Mode.IsDir() != newNode.Attrib.Mode.IsDir() {
+		return nil, errors.New("can't compare a file with a directory")
+	}
+
+	d := &differ{[]Change{}, make(map[int]diffEntry), make(map[int]diffEntry)}
+	if err = d.compare(oldNode, newNode, "/", "/"); err != nil {
+		return nil, err
+	}
+	if err = d.matchRenames(); err != nil {
+		return nil, err
+	}
+	sort.Slice(d.changes, func(i, j int) bool { return d.changes[i].Path < d.changes[j].Path })
+	return d.changes, nil
+}
+
+/* loads the child versions of a directory version. fails if any of them can't be had */
+func versionChildren(node *MyNode, path string) (map[string]*MyNode, error) {
+	children := make(map[string]*MyNode)
+	for name, stub := range node.Kids {
+		child, err := LoadNodeVersion(trace.None, stub.Vid, stub.LastWriter)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", pathpkg.Join(path, name), err)
+		}
+		if child.Vid != stub.Vid {
+			return nil, fmt.Errorf("%s: version %s: %w", pathpkg.Join(path, name), stub.Vid, ErrVersionMissing)
+		}
+		children[name] = child
+	}
+	return children, nil
+}
+
+/* the node's own attributes that differ between two of its versions. mtime isn't one, it changes with the contents */
+func attrChanges(oldNode *MyNode, newNode *MyNode) []string {
+	attrs := []string{}
+	o, n := oldNode.Attrib, newNode.Attrib
+	if o.Mode != n.Mode {
+		attrs = append(attrs, fmt.Sprintf("mode %v -> %v", o.Mode, n.Mode))
+	}
+	if o.Uid != n.Uid {
+		attrs = append(attrs, fmt.Sprintf("uid %d -> %d", o.Uid, n.Uid))
+	}
+	if o.Gid != n.Gid {
+		attrs = append(attrs, fmt.Sprintf("gid %d -> %d", o.Gid, n.Gid))
+	}
+	if oldNode.Replicas != newNode.Replicas {
+		attrs = append(attrs, fmt.Sprintf("replicas %d -> %d", oldNode.Replicas, newNode.Replicas))
+	}
+	return attrs
+}
+
+/* compares two versions of what is the same node, or at least at the same path */
+func (d *differ) compare(oldNode *MyNode, newNode *MyNode, oldPath string, newPath string) error {
+	if oldNode.Vid == newNode.Vid {
+		return nil
+	}
+	attrs := attrChanges(oldNode, newNode)
+	if !newNode.Attrib.Mode.IsDir() {
+		changed, removed := chunkChanges(oldNode, newNode)
+		if len(changed) > 0 || len(removed) > 0 || len(attrs) > 0 {
+			d.changes = append(d.changes, Change{CHANGE_MODIFIED, newPath, "", newNode.NodeID, false, changed, removed, attrs})
+		}
+		return nil
+	}
+	if len(attrs) > 0 {
+		d.changes = append(d.changes, Change{CHANGE_MODIFIED, newPath, "", newNode.NodeID, true, nil, nil, attrs})
+	}
+
+	oldKids, err := versionChildren(oldNode, oldPath)
+	if err != nil {
+		return err
+	}
+	newKids, err := versionChildren(newNode, newPath)
+	if err != nil {
+		return err
+	}
+	for name, o := range oldKids {
+		n, found := newKids[name]
+		if found && n.NodeID == o.NodeID && n.Attrib.Mode.IsDir() == o.Attrib.Mode.IsDir() {
+			err = d.compare(o, n, pathpkg.Join(oldPath, name), pathpkg.Join(newPath, name))
+		} else {
+			err = d.oneSided(d.oldOnly, o, pathpkg.Join(oldPath, name), oldNode.NodeID, true)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for name, n := range newKids {
+		o, found := oldKids[name]
+		if !found || n.NodeID != o.NodeID || n.Attrib.Mode.IsDir() != o.Attrib.Mode.IsDir() {
+			if err = d.oneSided(d.newOnly, n, pathpkg.Join(newPath, name), newNode.NodeID, true); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+/* records a node found on one side only, and everything under it since some of it may have moved */
+func (d *differ) oneSided(side map[int]diffEntry, node *MyNode, path string, parentID int, top bool) error {
+	side[node.NodeID] = diffEntry{path, node, parentID, top}
+	if !node.Attrib.Mode.IsDir() {
+		return nil
+	}
+	children, err := versionChildren(node, path)
+	if err != nil {
+		return err
+	}
+	for name, child := range children {
+		if err = d.oneSided(side, child, pathpkg.Join(path, name), node.NodeID, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/* pairs up what was removed with what was added by NodeID, and reports the rest */
+func (d *differ) matchRenames() error {
+	for id, n := range d.newOnly {
+		o, found := d.oldOnly[id]
+		if !found || o.node.Attrib.Mode.IsDir() != n.node.Attrib.Mode.IsDir() {
+			continue
+		}
+		delete(d.oldOnly, id)
+		delete(d.newOnly, id)
+		/* moving a directory moves everything in it, only its own move is reported */
+		movedWithParent := pathpkg.Base(o.path) == pathpkg.Base(n.path) && o.parentID == n.parentID
+		if o.path != n.path && !movedWithParent {
+			d.changes = append(d.changes, Change{CHANGE_RENAMED, n.path, o.path, id, n.node.Attrib.Mode.IsDir(), nil, nil, nil})
+		}
+		if !n.node.Attrib.Mode.IsDir() {
+			if err := d.compare(o.node, n.node, o.path, n.path); err != nil {
+				return err
+			}
+		} else if attrs := attrChanges(o.node, n.node); len(attrs) > 0 {
+			d.changes = append(d.changes, Change{CHANGE_MODIFIED, n.path, "", id, true, nil, nil, attrs})
+		}
+	}
+
+	/* what was under a removed or added directory is implied by it */
+	for id, o := range d.oldOnly {
+		if o.top || !d.parentListed(o.path, d.oldOnly) {
+			d.changes = append(d.changes, Change{CHANGE_REMOVED, o.path, "", id, o.node.Attrib.Mode.IsDir(), nil, nil, nil})
+		}
+	}
+	for id, n := range d.newOnly {
+		if n.top || !d.parentListed(n.path, d.newOnly) {
+			d.changes = append(d.changes, Change{CHANGE_ADDED, n.path, "", id, n.node.Attrib.Mode.IsDir(), nil, nil, nil})
+		}
+	}
+	return nil
+}
+
+/* true if the parent of path is still listed on that side, i.e. is removed or added itself */
+func (d *differ) parentListed(path string, side map[int]diffEntry) bool {
+	parent := pathpkg.Dir(path)
+	for _, e := range side {
+		if e.path == parent {
+			return true
+		}
+	}
+	return false
+}
+
+/* byte ranges of newNode made of chunks oldNode doesn't have, and the other way round */
+func chunkChanges(oldNode *MyNode, newNode *MyNode) ([]ByteRange, []ByteRange) {
+	return missingRanges(newNode, oldNode), missingRanges(oldNode, newNode)
+}
+
+/* ranges of a made of chunks b doesn't have, adjacent ones merged */
+func missingRanges(a *MyNode, b *MyNode) []ByteRange {
+	have := make(map[string]bool)
+	for _, hash := range b.DataBlocks {
+		have[hash] = true
+	}
+	ranges := []ByteRange{}
+	for i, hash := range a.DataBlocks {
+		if have[hash] {
+			continue
+		}
+		r := ByteRange{a.BlockOffsets[i], a.BlockLengths[i]}
+		if last := len(ranges) - 1; last >= 0 && ranges[last].Offset + ranges[last].Length == r.Offset {
+			ranges[last].Length += r.Length
+		} else {
+			ranges = append(ranges, r)
+		}
+	}
+	return ranges
+}
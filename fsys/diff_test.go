@@ -0,0 +1,101 @@
+package fsys
+
+import (
+	"os"
+	"errors"
+	"testing"
+	"bazil.org/fuse"
+)
+
+func putVersion(t *testing.T, n MyNode) *Stub {
+	putJSON(t, NODE_VERSION_KEY + ":" + n.Vid, n)
+	return &Stub{n.NodeID, n.Vid, n.Name, n.Attrib, n.LastWriter}
+}
+
+func testDir(id int, vid string, name string, mode os.FileMode, kids ...*Stub) MyNode {
+	n := MyNode{NodeID: id, Vid: vid, Name: name, LastWriter: 1, Kids: make(map[string]*Stub)}
+	n.Attrib = fuse.Attr{Mode: os.ModeDir | mode}
+	for _, k := range kids {
+		n.Kids[k.Name] = k
+	}
+	return n
+}
+
+func testFile(id int, vid string, name string, blocks ...string) MyNode {
+	n := MyNode{NodeID: id, Vid: vid, Name: name, LastWriter: 1, DataBlocks: blocks}
+	n.Attrib = fuse.Attr{Mode: 0644}
+	for i := range blocks {
+		n.BlockOffsets = append(n.BlockOffsets, 4 * i)
+		n.BlockLengths = append(n.BlockLengths, 4)
+	}
+	return n
+}
+
+func TestDiff(t *testing.T) {
+	openTestStore(t)
+	SetMyPid(1)
+	InitMembership()
+
+	x := putVersion(t, testFile(12, "x1", "x", "h9"))
+	oldRoot := testDir(ROOT_NODEID, "r1", "/", 0755,
+		putVersion(t, testFile(10, "a1", "a", "h1", "h2")),
+		putVersion(t, testDir(11, "d1", "d", 0755, x)))
+	putVersion(t, oldRoot)
+	/* a renamed to b and its second chunk rewritten, d closed to others, c created */
+	newRoot := testDir(ROOT_NODEID, "r2", "/", 0755,
+		putVersion(t, testFile(10, "a2", "b", "h1", "h3")),
+		putVersion(t, testDir(11, "d2", "d", 0700, x)),
+		putVersion(t, testFile(13, "c1", "c")))
+	putVersion(t, newRoot)
+
+	changes, err := Diff("r1", "r2")
+	if err != nil {
+		t.Fatalf("diff: %v", err)
+	}
+	got := make(map[string]Change)
+	for _, c := range changes {
+		got[c.Kind.String() + " " + c.Path] = c
+	}
+	if len(got) != 4 {
+		t.Errorf("changes %v, want 4", changes)
+	}
+	if c, found := got["renamed /b"]; !found || c.OldPath != "/a" {
+		t.Errorf("no rename of /a to /b in %v", changes)
+	}
+	if c, found := got["modified /b"]; !found || len(c.Changed) != 1 || c.Changed[0] != (ByteRange{4, 4}) || len(c.Removed) != 1 {
+		t.Errorf("no change of [4,8) in /b in %v", changes)
+	}
+	if c, found := got["modified /d"]; !found || len(c.Attrs) != 1 || !c.Dir {
+		t.Errorf("no mode change of /d in %v", changes)
+	}
+	if _, found := got["added /c"]; !found {
+		t.Errorf("no /c added in %v", changes)
+	}
+
+	/* the same the other way round */
+	back, err := Diff("r2", "r1")
+	if err != nil {
+		t.Fatalf("diff back: %v", err)
+	}
+	if len(back) != len(changes) {
+		t.Errorf("diff back %v, want as many changes as %v", back, changes)
+	}
+}
+
+func TestDiffFailsOnMissingVersions(t *testing.T) {
+	openTestStore(t)
+	SetMyPid(1)
+	InitMembership()
+
+	putVersion(t, testDir(ROOT_NODEID, "r1", "/", 0755))
+	lost := &Stub{NodeID: 10, Vid: "lost", Name: "a", LastWriter: 2}
+	lost.Attrib.Mode = 0644
+	putVersion(t, testDir(ROOT_NODEID, "r2", "/", 0755, lost))
+
+	if _, err := Diff("r1", "r2"); !errors.Is(err, ErrPeerUnreachable) {
+		t.Errorf("diff with a version nobody has: %v, want ErrPeerUnreachable", err)
+	}
+	if _, err := Diff("r1", "nothing"); err == nil {
+		t.Error("diff against a version nobody has succeeded")
+	}
+}
@@ -0,0 +1,42 @@
+package fsys
+
+import (
+	"errors"
+	"syscall"
+	"bazil.org/fuse"
+)
+
+/*
+======================
+ERRORS
+=======================
+*/
+
+/*
+	Loading a version or a chunk fails with one of these (wrapped with the vid or hash), so a
+	handler can tell "nobody has it" from "nobody answered" and fail just the one operation.
+*/
+
+var ErrVersionMissing = errors.New("version not available")
+var ErrChunkMissing = errors.New("chunk not available")
+var ErrPeerUnreachable = errors.New("no peer could be reached")
+var ErrCorrupt = errors.New("corrupt record")
+
+/* what anything that would change the filesystem or the store fails with on a read-only replica */
+var ErrReadOnly = errors.New("read-only replica")
+
+/* what a FUSE handler returns for err: EAGAIN if it may work later, ENOENT if the node can't be found anywhere, EROFS on a read-only replica, EIO otherwise */
+func fuseError(err error) fuse.Error {
+	if err == nil {
+		return nil
+	}
+	fuseLog.Warn("operation failed", "err", err)
+	if errors.Is(err, ErrPeerUnreachable) {
+		return fuse.Errno(syscall.EAGAIN)
+	} else if errors.Is(err, ErrVersionMissing) {
+		return fuse.ENOENT
+	} else if errors.Is(err, ErrReadOnly) {
+		return fuse.Errno(syscall.EROFS)
+	}
+	return fuse.EIO
+}
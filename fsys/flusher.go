@@ -2,9 +2,10 @@ package fsys
 
 import (
 	"time"
+	"sync"
 	"p4/storage"
 	"p4/lock"
-	"p4/util"
+	"p4/trace"
 	"fmt"
 	"encoding/json"
 )
@@ -18,66 +19,212 @@ func init() {
 
 const SLEEP_SECONDS int = 5
 
+/*
+	How often dirty nodes are written back and published. With a fixed interval the flusher
+	runs every FlushInterval. Adaptive, it runs once writes have paused for FLUSH_QUIET, so a
+	lone write goes out almost at once, but never waits longer than FlushInterval after the
+	first unflushed write, so a burst is batched into one update per interval.
+*/
+var FlushInterval = time.Duration(SLEEP_SECONDS) * time.Second
+var AdaptiveFlush bool
+
+const FLUSH_QUIET = 500 * time.Millisecond
+
+/* parses the -flush flag: an interval like 5s, or adaptive (batching up to 5s) */
+func SetFlushInterval(spec string) error {
+	if spec == "adaptive" {
+		AdaptiveFlush = true
+		return nil
+	}
+	d, err := time.ParseDuration(spec)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("bad flush interval %q", spec)
+	}
+	FlushInterval = d
+	return nil
+}
+
+/* writes since the last flush, and whether someone asked for a flush. protected by activityLock */
+var activity struct {
+	first time.Time
+	last time.Time
+	requested bool
+}
+var activityLock sync.Mutex
+var flushWakeup = make(chan bool, 1)
+
+func wakeFlusher() {
+	select {
+		case flushWakeup <- true:
+		default:
+	}
+}
+
+/* notes that something was changed */
+func noteWrite() {
+	activityLock.Lock()
+	now := time.Now()
+	if activity.first.IsZero() {
+		activity.first = now
+	}
+	activity.last = now
+	activityLock.Unlock()
+	if AdaptiveFlush {
+		wakeFlusher()
+	}
+}
+
+/* asks the flusher to run now, e.g. because a file was closed */
+func requestFlush() {
+	activityLock.Lock()
+	activity.requested = true
+	activityLock.Unlock()
+	wakeFlusher()
+}
+
+/* how long the flusher should wait, lastFlush being when it last ran */
+func nextFlush(lastFlush time.Time) time.Duration {
+	activityLock.Lock()
+	defer activityLock.Unlock()
+	deadline := lastFlush.Add(FlushInterval)
+	if activity.requested {
+		return 0
+	} else if AdaptiveFlush && !activity.first.IsZero() {
+		deadline = activity.last.Add(FLUSH_QUIET)
+		if latest := activity.first.Add(FlushInterval); latest.Before(deadline) {
+			deadline = latest
+		}
+	}
+	return time.Until(deadline)
+}
+
+func flushed() {
+	activityLock.Lock()
+	activity.first = time.Time{}
+	activity.last = time.Time{}
+	activity.requested = false
+	activityLock.Unlock()
+}
+
 func ClearDirtyNodesList() {
 	for k := range dirtyNodesList {
 		delete(dirtyNodesList, k)
 	}
+	dirtyNodes.Set(0)
 }
 
 func Flush(quit chan bool, f *MyFS) {
+	lastFlush := time.Now()
 	for {
+		if ReadOnly {
+			/* nothing can get dirty, and nothing is ever published */
+			select {
+				case <-quit:
+					storage.Close()
+					return
+				case <-time.After(FlushInterval):
+			}
+			continue
+		}
+
 		select {
 			case <-quit: {
 				storage.Close()
 				return
 			}
-			default: {
+			case <-flushWakeup: {
+				/* something changed, work out the wait again */
+				continue
+			}
+			case <-time.After(nextFlush(lastFlush)): {
 				lock.LOCK.Lock()
-				FlushFilesystem(f)
-				if len(dirtyNodesList) > 0 {
-					for k := range dirtyNodesList {
-						util.P_out("dirty: %s => %s", k, dirtyNodesList[k].Name)
-					}
-					SendUpdateMessage(dirtyNodesList)
-					ClearDirtyNodesList()
+				start := time.Now()
+				if err := FlushFilesystem(f); err != nil {
+					/* publish nothing until everything could be saved */
+					flushLog.Warn("could not write back, retrying next round", "err", err)
+				} else if len(dirtyNodesList) > 0 {
+					publishDirty()
+				} else if HasUnackedUpdates() {
+					SendLogHead()
 				}
+				flushed()
+				/* what was just written back can be collapsed now */
+				evictNodes()
+				flushSeconds.Observe(time.Since(start).Seconds())
 				lock.LOCK.Unlock()
-				time.Sleep(time.Duration(SLEEP_SECONDS) * time.Second)
+				lastFlush = time.Now()
 			}
 		}
 	}
 }
 
+/* logs and publishes everything in dirtyNodesList. caller holds lock.LOCK */
+func publishDirty() {
+	for k := range dirtyNodesList {
+		flushLog.Debug("dirty", "path", k, "vid", dirtyNodesList[k].Vid)
+	}
+	span := trace.Start(trace.None, "publish", "nodes", fmt.Sprintf("%d", len(dirtyNodesList)))
+	defer span.End()
+	/* log before publishing, so peers that miss the broadcast can still fetch it */
+	entry, err := AppendUpdate(dirtyNodesList)
+	if err != nil {
+		flushLog.Warn("could not log update, retrying next round", "err", err)
+		span.SetError(err)
+		return
+	}
+	/* in this order: chunks not queued for replication yet are the new ones, whose data is published */
+	SendUpdateMessage(span.Context(), entry)
+	queueReplication(entry)
+	ClearDirtyNodesList()
+}
+
 
-func FlushFilesystem(f *MyFS) {
+func FlushFilesystem(f *MyFS) error {
 	r, _ := f.Root()
 	mynoder, _ := r.(*MyNode)
-	writeBack(mynoder)
+	return writeBack(mynoder)
 }
 
-func writeBack(root *MyNode) {
+/* on error, whatever couldn't be saved stays dirty and is tried again on the next flush */
+func writeBack(root *MyNode) error {
 	// if root isn't dirty, no child is dirty since when a child is updated, the changes always propagate up to the root
 	if root == nil || !root.dirty {
-		if root != nil {
-		}
-		return
+		return nil
 	}
 
 	if root.Attrib.Mode.IsDir() {
-		AssertExpanded(root)
+		if err := AssertExpanded(trace.None, root); err != nil {
+			return err
+		}
 		// if im a dir, recursively save children, then save myself (postorder)
-		for _, v := range root.children {
-			writeBack(v);
+		for k, v := range root.children {
+			if err := writeBack(v); err != nil {
+				return err
+			}
+			/* the child's version id changed when it was saved, point at the version that was stored */
+			if stub, found := root.Kids[k]; found && stub.NodeID == v.NodeID {
+				stub.Vid = v.Vid
+			}
 		}
 	} else {
-		root.WriteBackData()
+		if err := root.WriteBackData(); err != nil {
+			return err
+		}
 	}
 
-	originalVid := root.Vid
+	saveVersion(root)
+	root.dirty = false
+	return nil
+}
+
+/* stores the current version of a node whose children are saved already */
+func saveVersion(root *MyNode) {
 	root.Vid = GenerateVersionId(root)	/* update vid */
 	d := *root;
-	util.P_out("in dirty list: %s => %v", originalVid, d)
-	dirtyNodesList[originalVid] = d
+	path := nodePath(root)
+	flushLog.Debug("written back", "path", path, "vid", d.Vid)
+	dirtyNodesList[path] = d
+	dirtyNodes.Set(float64(len(dirtyNodesList)))
 
 	// ive been updated, save me
 	nodestr, _ := json.Marshal(root)
@@ -85,12 +232,37 @@ func writeBack(root *MyNode) {
 
 	RegisterNodeVersion(root.NodeID, root.Vid)
 
-	//util.P_out("write back %s", root.Name)
-	root.dirty = false
-
 	// save the state as well (only once at the very end)
-	if root.Name == "/" {
+	if root.parent == nil {
+		State.Root_version_bootstrap = root.Vid
 		statestr, _ := json.Marshal(State)
 		storage.Put([]byte(STATE_KEY), statestr)
 	}
 }
+
+/*
+	Writes back n and everything under it, then each of its ancestors, so the root points at
+	what was written. Other dirty subtrees are left to the flusher: an ancestor with dirty
+	children still points at their last saved versions and stays dirty. Caller holds lock.LOCK.
+*/
+func writeBackPath(n *MyNode) error {
+	if err := writeBack(n); err != nil {
+		return err
+	}
+	for child, p := n, n.parent; p != nil; child, p = p, p.parent {
+		if !p.dirty {
+			continue
+		}
+		if stub, found := p.Kids[child.Name]; found && stub.NodeID == child.NodeID {
+			stub.Vid = child.Vid
+		}
+		saveVersion(p)
+		p.dirty = false
+		for _, c := range p.children {
+			if c.dirty {
+				p.dirty = true
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,384 @@
+package fsys
+
+import (
+	"fmt"
+	"strings"
+	"strconv"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"p4/storage"
+)
+
+/*
+======================
+STORE FORMAT
+=======================
+*/
+
+/*
+	The layout of the store (its key namespaces and the JSON kept under them) has a version,
+	kept under FORMAT_KEY. Every change to the layout bumps FORMAT_VERSION and adds the
+	migration that takes a store from the version before to the new one. At startup a store
+	is brought up to date one step at a time, recording its version after each step, so an
+	upgrade that is cut short carries on from where it stopped. A store of a newer version
+	than this build knows is left alone and not mounted.
+
+	Stores from before the version record have version 0.
+*/
+
+const FORMAT_KEY string = "FORMAT"
+
+const FORMAT_VERSION int = 3
+
+type migration struct {
+	version int		/* the version the store has once it ran */
+	what string
+	run func() error
+}
+
+var migrations = []migration{
+	{1, "drop the inode counter from the state, inodes come from node ids", dropInodeCounter},
+	{2, "name versions by their hash instead of their path", hashVersionIds},
+	{3, "give legacy node ids the pid of the replica that created them", prefixLegacyNodeIds},
+}
+
+func storeVersion() (int, error) {
+	val, err := storage.Get([]byte(FORMAT_KEY))
+	if err != nil {
+		/* no record: either a new store or one from before it */
+		empty := true
+		storage.Iterate([]byte{}, func(key []byte, val []byte) bool {
+			empty = false
+			return false
+		})
+		if empty {
+			return FORMAT_VERSION, nil
+		}
+		return 0, nil
+	}
+	var version int
+	if err = json.Unmarshal(val, &version); err != nil {
+		return 0, fmt.Errorf("format record: %v: %w", err, ErrCorrupt)
+	}
+	return version, nil
+}
+
+func setStoreVersion(version int) error {
+	val, _ := json.Marshal(version)
+	return storage.Put([]byte(FORMAT_KEY), val)
+}
+
+/* brings the store up to FORMAT_VERSION. fails, changing nothing, if it is of a newer version */
+func UpgradeStore() error {
+	version, err := storeVersion()
+	if err != nil {
+		return err
+	}
+	if version > FORMAT_VERSION {
+		return fmt.Errorf("the store is of format %d, this build only knows up to %d: run a newer gofs", version, FORMAT_VERSION)
+	}
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+		storeLog.Info("upgrading store", "from", version, "to", m.version, "change", m.what)
+		if err = m.run(); err != nil {
+			return fmt.Errorf("upgrading the store to format %d (%s): %v", m.version, m.what, err)
+		}
+		if err = setStoreVersion(m.version); err != nil {
+			return err
+		}
+		version = m.version
+	}
+	if err = setStoreVersion(FORMAT_VERSION); err != nil {
+		return err
+	}
+	return storage.Sync()
+}
+
+/*
+	Migrations. Each one sees the store as the version before left it, so it works on the raw
+	records rather than on today's structs.
+*/
+
+/* 1: STATE lost NextInode when inodes started to come from node ids */
+func dropInodeCounter() error {
+	val, err := storage.Get([]byte(STATE_KEY))
+	if err != nil {
+		return nil
+	}
+	var state map[string]json.RawMessage
+	if err = json.Unmarshal(val, &state); err != nil {
+		return fmt.Errorf("state: %v: %w", err, ErrCorrupt)
+	}
+	delete(state, "NextInode")
+	val, _ = json.Marshal(state)
+	return storage.Put([]byte(STATE_KEY), val)
+}
+
+func isHashVid(vid string) bool {
+	_, err := hex.DecodeString(vid)
+	return len(vid) == 2 * sha1.Size && err == nil
+}
+
+/*
+	2: version ids used to be the node's path, so every version overwrote the one before. They
+	are hashes now (see GenerateVersionId). Every record still under a path id gets a hash id,
+	children first so the stubs pointing at them can be updated: the hash of the record as it is,
+	which still holds its path id and so differs from every other.
+*/
+func hashVersionIds() error {
+	records := make(map[string]map[string]json.RawMessage)
+	var err error
+	storage.Iterate([]byte(NODE_VERSION_KEY + ":"), func(key []byte, val []byte) bool {
+		vid := strings.TrimPrefix(string(key), NODE_VERSION_KEY + ":")
+		if isHashVid(vid) {
+			return true
+		}
+		var rec map[string]json.RawMessage
+		if err = json.Unmarshal(val, &rec); err != nil {
+			err = fmt.Errorf("version %s: %v: %w", vid, err, ErrCorrupt)
+			return false
+		}
+		records[vid] = rec
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	renamed := make(map[string]string)
+	var rename func(vid string) string
+	rename = func(vid string) string {
+		if hashed, done := renamed[vid]; done {
+			return hashed
+		}
+		rec, found := records[vid]
+		if !found {
+			return vid
+		}
+		var kids map[string]map[string]json.RawMessage
+		json.Unmarshal(rec["Kids"], &kids)
+		for _, kid := range kids {
+			var kidVid string
+			json.Unmarshal(kid["Vid"], &kidVid)
+			kid["Vid"], _ = json.Marshal(rename(kidVid))
+		}
+		if kids != nil {
+			rec["Kids"], _ = json.Marshal(kids)
+		}
+		val, _ := json.Marshal(rec)
+		sum := sha1.Sum(val)
+		hashed := hex.EncodeToString(sum[:])
+		rec["Vid"], _ = json.Marshal(hashed)
+		renamed[vid] = hashed
+		return hashed
+	}
+	for vid := range records {
+		rename(vid)
+	}
+
+	/* the new records and everything pointing at them first, so a rerun finds the old ones still there */
+	for vid, rec := range records {
+		val, _ := json.Marshal(rec)
+		if err = storage.Put([]byte(fmt.Sprintf("%s:%v", NODE_VERSION_KEY, renamed[vid])), val); err != nil {
+			return err
+		}
+	}
+	lists := make(map[string][]string)
+	storage.Iterate([]byte(NODE_VERSION_LIST + ":"), func(key []byte, val []byte) bool {
+		var list []string
+		json.Unmarshal(val, &list)
+		seen := make(map[string]bool)
+		hashedList := []string{}
+		for _, vid := range list {
+			if hashed, found := renamed[vid]; found {
+				vid = hashed
+			}
+			if !seen[vid] {
+				seen[vid] = true
+				hashedList = append(hashedList, vid)
+			}
+		}
+		lists[string(key)] = hashedList
+		return true
+	})
+	for key, list := range lists {
+		val, _ := json.Marshal(list)
+		if err = storage.Put([]byte(key), val); err != nil {
+			return err
+		}
+	}
+	if val, gerr := storage.Get([]byte(STATE_KEY)); gerr == nil {
+		var state map[string]json.RawMessage
+		if err = json.Unmarshal(val, &state); err != nil {
+			return fmt.Errorf("state: %v: %w", err, ErrCorrupt)
+		}
+		var root string
+		json.Unmarshal(state["Root_version_bootstrap"], &root)
+		if hashed, found := renamed[root]; found {
+			state["Root_version_bootstrap"], _ = json.Marshal(hashed)
+			val, _ = json.Marshal(state)
+			if err = storage.Put([]byte(STATE_KEY), val); err != nil {
+				return err
+			}
+		}
+	}
+
+	for vid := range records {
+		if err = storage.Delete([]byte(fmt.Sprintf("%s:%v", NODE_VERSION_KEY, vid))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/*
+	3: node ids used to be counted from 1 on every replica, so nodes created on different
+	replicas could have the same one, and their versions went on one list. They are (pid,
+	counter) pairs now (see makeNodeID). The versions on a legacy list are told apart by their
+	creation time, which every version of a node keeps; the writer of the first of them created
+	the node, and its pid goes in front of the old id, which that replica handed out once only.
+	The records, the stubs pointing at them and the lists are rewritten. Version ids stay as
+	they are, so they are no longer the hash of their record: nothing relies on that, a version
+	id is only a name (fsck checks that a record is stored under the id it says it has, never its
+	hash, see Fsck). A node none of whose versions is stored here keeps its id until the store is
+	upgraded again.
+*/
+func prefixLegacyNodeIds() error {
+	legacy := func(id int) bool {
+		return id > ROOT_NODEID && id < 1 << NODEID_PID_SHIFT
+	}
+	type version struct {
+		NodeID int
+		Attrib struct {
+			Crtime json.RawMessage
+		}
+		LastWriter int
+	}
+	records := make(map[string]map[string]json.RawMessage)
+	versions := make(map[string]version)
+	var err error
+	storage.Iterate([]byte(NODE_VERSION_KEY + ":"), func(key []byte, val []byte) bool {
+		vid := strings.TrimPrefix(string(key), NODE_VERSION_KEY + ":")
+		var rec map[string]json.RawMessage
+		var v version
+		if err = json.Unmarshal(val, &rec); err == nil {
+			err = json.Unmarshal(val, &v)
+		}
+		if err != nil {
+			err = fmt.Errorf("version %s: %v: %w", vid, err, ErrCorrupt)
+			return false
+		}
+		records[vid] = rec
+		versions[vid] = v
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	lists := make(map[int][]string)
+	storage.Iterate([]byte(NODE_VERSION_LIST + ":"), func(key []byte, val []byte) bool {
+		id, perr := strconv.Atoi(strings.TrimPrefix(string(key), NODE_VERSION_LIST + ":"))
+		if perr != nil || !legacy(id) {
+			return true
+		}
+		var list []string
+		if err = json.Unmarshal(val, &list); err != nil {
+			err = fmt.Errorf("version list %d: %v: %w", id, err, ErrCorrupt)
+			return false
+		}
+		lists[id] = list
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	/* the nodes behind a legacy id, by creation time, first version first */
+	type legacyNode struct {
+		id int
+		crtime string
+	}
+	ids := make(map[legacyNode]int)
+	nodes := make(map[int][]int)
+	for id, list := range lists {
+		for _, vid := range list {
+			v, found := versions[vid]
+			if !found || v.LastWriter <= 0 {
+				continue
+			}
+			node := legacyNode{id, string(v.Attrib.Crtime)}
+			if _, seen := ids[node]; !seen {
+				ids[node] = makeNodeID(v.LastWriter, id)
+				nodes[id] = append(nodes[id], ids[node])
+			}
+		}
+	}
+	newLists := make(map[int][]string)
+	for id, list := range lists {
+		for _, vid := range list {
+			v, found := versions[vid]
+			if newID, known := ids[legacyNode{id, string(v.Attrib.Crtime)}]; found && known {
+				newLists[newID] = append(newLists[newID], vid)
+			} else if len(nodes[id]) == 1 {
+				/* not stored here, but there is only the one node it can be of */
+				newLists[nodes[id][0]] = append(newLists[nodes[id][0]], vid)
+			} else if len(nodes[id]) > 1 {
+				storeLog.Warn("dropping a version of a legacy node id from its list, it isn't stored here to tell whose it is", "nodeid", id, "vid", vid)
+			}
+		}
+	}
+
+	/* the records and everything pointing at them first, so a rerun finds the old lists still there */
+	for vid, rec := range records {
+		changed := false
+		if v := versions[vid]; legacy(v.NodeID) {
+			if newID, known := ids[legacyNode{v.NodeID, string(v.Attrib.Crtime)}]; known {
+				var attrib map[string]json.RawMessage
+				json.Unmarshal(rec["Attrib"], &attrib)
+				attrib["Inode"], _ = json.Marshal(nodeInode(newID))
+				rec["Attrib"], _ = json.Marshal(attrib)
+				rec["NodeID"], _ = json.Marshal(newID)
+				changed = true
+			}
+		}
+		var kids map[string]map[string]json.RawMessage
+		json.Unmarshal(rec["Kids"], &kids)
+		for _, kid := range kids {
+			var stub version
+			json.Unmarshal(kid["NodeID"], &stub.NodeID)
+			json.Unmarshal(kid["Attrib"], &stub.Attrib)
+			if !legacy(stub.NodeID) {
+				continue
+			}
+			if newID, known := ids[legacyNode{stub.NodeID, string(stub.Attrib.Crtime)}]; known {
+				kid["NodeID"], _ = json.Marshal(newID)
+				changed = true
+			}
+		}
+		if !changed {
+			continue
+		}
+		if kids != nil {
+			rec["Kids"], _ = json.Marshal(kids)
+		}
+		val, _ := json.Marshal(rec)
+		if err = storage.Put([]byte(fmt.Sprintf("%s:%v", NODE_VERSION_KEY, vid)), val); err != nil {
+			return err
+		}
+	}
+	for id, list := range newLists {
+		val, _ := json.Marshal(list)
+		if err = storage.Put([]byte(fmt.Sprintf("%s:%d", NODE_VERSION_LIST, id)), val); err != nil {
+			return err
+		}
+	}
+	for id := range nodes {
+		if err = storage.Delete([]byte(fmt.Sprintf("%s:%d", NODE_VERSION_LIST, id))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
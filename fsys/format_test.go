@@ -0,0 +1,219 @@
+package fsys
+
+import (
+	"os"
+	"fmt"
+	"time"
+	"testing"
+	"encoding/json"
+	"bazil.org/fuse"
+	"p4/storage"
+)
+
+func openTestStore(t *testing.T) {
+	storage.Init(t.TempDir())
+	t.Cleanup(func() { storage.Close() })
+}
+
+func putJSON(t *testing.T, key string, v interface{}) {
+	val, _ := json.Marshal(v)
+	if err := storage.Put([]byte(key), val); err != nil {
+		t.Fatalf("put %s: %v", key, err)
+	}
+}
+
+func getJSON(t *testing.T, key string, v interface{}) bool {
+	val, err := storage.Get([]byte(key))
+	if err != nil {
+		return false
+	}
+	if err = json.Unmarshal(val, v); err != nil {
+		t.Fatalf("%s: %v", key, err)
+	}
+	return true
+}
+
+/* the records as the first gofs wrote them: its MyNode, Stub and STATE, exported fields only */
+type baselineStub struct {
+	NodeID int
+	Vid string
+	Name string
+	Attrib fuse.Attr
+	LastWriter int
+}
+
+type baselineNode struct {
+	NodeID int
+	Vid string
+	Name string
+	Attrib fuse.Attr
+	ChildVids map[string]string
+	Kids map[string]*baselineStub
+	LastWriter int
+	BlockOffsets []int
+	BlockLengths []int
+	DataBlocks []string
+}
+
+type baselineState struct {
+	Root_version_bootstrap string
+	NextInode uint64
+	NextNId int
+}
+
+/* sha1 of "hello", the contents of the only file */
+const testChunk = "aaf4c61ddcc5e8a2dabede0f3b482cd9aea9434d"
+
+/*
+	A store as the first gofs left it: versions named by their path (the names up to the root,
+	each followed by a slash), one record per path, node ids counted from 1 on every replica (so
+	"a", created on replica 1, and "b", created on replica 2, have the same one and share a
+	version list, with duplicates), the chunks under DATA_KEY and an inode counter in the state.
+	It kept nothing else.
+*/
+func writeBaselineStore(t *testing.T) {
+	created := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	a := baselineNode{NodeID: 2, Vid: "a///", Name: "a", LastWriter: 1, DataBlocks: []string{testChunk}, BlockOffsets: []int{0}, BlockLengths: []int{5}}
+	a.Attrib = fuse.Attr{Inode: 5, Mode: 0644, Size: 5, Crtime: created}
+	b := baselineNode{NodeID: 2, Vid: "b///", Name: "b", LastWriter: 2}
+	b.Attrib = fuse.Attr{Inode: 6, Mode: 0644, Crtime: created.Add(time.Minute)}
+	root := baselineNode{NodeID: ROOT_NODEID, Vid: "//", Name: "/", LastWriter: 1}
+	root.Attrib = fuse.Attr{Inode: 1, Mode: os.ModeDir | 0755, Crtime: created}
+	root.Kids = map[string]*baselineStub{
+		"a": &baselineStub{a.NodeID, a.Vid, a.Name, a.Attrib, a.LastWriter},
+		"b": &baselineStub{b.NodeID, b.Vid, b.Name, b.Attrib, b.LastWriter},
+	}
+	for _, n := range []baselineNode{root, a, b} {
+		putJSON(t, NODE_VERSION_KEY + ":" + n.Vid, n)
+	}
+	putJSON(t, NODE_VERSION_LIST + ":1", []string{"//", "//"})
+	putJSON(t, NODE_VERSION_LIST + ":2", []string{"a///", "b///", "a///"})
+	storage.Put([]byte(DATA_KEY + ":" + testChunk), []byte("hello"))
+	putJSON(t, STATE_KEY, baselineState{Root_version_bootstrap: "//", NextInode: 7, NextNId: 2})
+}
+
+func TestUpgradeBaselineStore(t *testing.T) {
+	openTestStore(t)
+	writeBaselineStore(t)
+
+	if err := UpgradeStore(); err != nil {
+		t.Fatalf("upgrade: %v", err)
+	}
+
+	var version int
+	if !getJSON(t, FORMAT_KEY, &version) || version != FORMAT_VERSION {
+		t.Fatalf("format record %d, want %d", version, FORMAT_VERSION)
+	}
+	var state map[string]json.RawMessage
+	getJSON(t, STATE_KEY, &state)
+	if _, found := state["NextInode"]; found {
+		t.Errorf("state still has NextInode: %v", state)
+	}
+	var rootVid string
+	json.Unmarshal(state["Root_version_bootstrap"], &rootVid)
+	if !isHashVid(rootVid) {
+		t.Fatalf("root version %q isn't a hash", rootVid)
+	}
+	storage.Iterate([]byte(NODE_VERSION_KEY + ":"), func(key []byte, val []byte) bool {
+		if vid := string(key[len(NODE_VERSION_KEY) + 1:]); !isHashVid(vid) {
+			t.Errorf("version %q left under its path", vid)
+		}
+		return true
+	})
+
+	var root MyNode
+	if !getJSON(t, NODE_VERSION_KEY + ":" + rootVid, &root) {
+		t.Fatalf("no root version %s", rootVid)
+	}
+	wantIDs := map[string]int{"a": makeNodeID(1, 2), "b": makeNodeID(2, 2)}
+	for name, id := range wantIDs {
+		stub, found := root.Kids[name]
+		if !found {
+			t.Fatalf("root lost %s", name)
+		}
+		if stub.NodeID != id {
+			t.Errorf("stub of %s has node id %d, want %d", name, stub.NodeID, id)
+		}
+		var kid MyNode
+		if !getJSON(t, NODE_VERSION_KEY + ":" + stub.Vid, &kid) {
+			t.Fatalf("stub of %s points at missing version %s", name, stub.Vid)
+		}
+		if kid.Name != name || kid.NodeID != id || kid.Attrib.Inode != nodeInode(id) {
+			t.Errorf("version of %s: name %q, node id %d, inode %d, want node id %d", name, kid.Name, kid.NodeID, kid.Attrib.Inode, id)
+		}
+		var list []string
+		getJSON(t, fmt.Sprintf("%s:%d", NODE_VERSION_LIST, id), &list)
+		if len(list) != 1 || list[0] != stub.Vid {
+			t.Errorf("version list of %s is %v, want [%s]", name, list, stub.Vid)
+		}
+	}
+	var list []string
+	if getJSON(t, NODE_VERSION_LIST + ":2", &list) {
+		t.Errorf("merged legacy version list still there: %v", list)
+	}
+	getJSON(t, NODE_VERSION_LIST + ":1", &list)
+	if len(list) != 1 || list[0] != rootVid {
+		t.Errorf("root version list is %v, want [%s]", list, rootVid)
+	}
+
+	if val, err := storage.Get([]byte(DATA_KEY + ":" + testChunk)); err != nil || string(val) != "hello" {
+		t.Errorf("chunk %s is %q (%v), want it untouched", testChunk, val, err)
+	}
+
+	/* upgrading again changes nothing */
+	if err := UpgradeStore(); err != nil {
+		t.Fatalf("second upgrade: %v", err)
+	}
+	getJSON(t, STATE_KEY, &state)
+	var again string
+	json.Unmarshal(state["Root_version_bootstrap"], &again)
+	if again != rootVid {
+		t.Errorf("second upgrade moved the root from %s to %s", rootVid, again)
+	}
+}
+
+/* the upgrade rewrites node ids inside records without renaming them, which fsck must not mind */
+func TestUpgradedStorePassesFsck(t *testing.T) {
+	openTestStore(t)
+	writeBaselineStore(t)
+	if err := UpgradeStore(); err != nil {
+		t.Fatalf("upgrade: %v", err)
+	}
+	var state map[string]json.RawMessage
+	getJSON(t, STATE_KEY, &state)
+	var rootVid string
+	json.Unmarshal(state["Root_version_bootstrap"], &rootVid)
+
+	report := Fsck(rootVid, false)
+	if !report.Clean() || report.Nodes != 3 || report.Chunks != 1 {
+		t.Errorf("fsck of the upgraded store: %d versions, %d chunks, problems %v", report.Nodes, report.Chunks, report.Problems)
+	}
+}
+
+func TestUpgradeRefusesNewerStore(t *testing.T) {
+	openTestStore(t)
+	putJSON(t, FORMAT_KEY, FORMAT_VERSION + 1)
+	putJSON(t, STATE_KEY, map[string]interface{}{"Root_version_bootstrap": "//", "NextInode": 7})
+
+	if err := UpgradeStore(); err == nil {
+		t.Fatal("upgraded a store of a newer format")
+	}
+	var version int
+	getJSON(t, FORMAT_KEY, &version)
+	var state map[string]json.RawMessage
+	getJSON(t, STATE_KEY, &state)
+	if _, found := state["NextInode"]; version != FORMAT_VERSION + 1 || !found {
+		t.Errorf("refused store was changed: format %d, state %v", version, state)
+	}
+}
+
+func TestNewStoreHasCurrentFormat(t *testing.T) {
+	openTestStore(t)
+	if err := UpgradeStore(); err != nil {
+		t.Fatalf("upgrade: %v", err)
+	}
+	var version int
+	if !getJSON(t, FORMAT_KEY, &version) || version != FORMAT_VERSION {
+		t.Errorf("new store has format %d, want %d", version, FORMAT_VERSION)
+	}
+}
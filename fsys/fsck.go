@@ -0,0 +1,249 @@
+package fsys
+
+import (
+	"fmt"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	pathpkg "path"
+	"p4/storage"
+	"p4/lock"
+	"p4/trace"
+)
+
+/*
+======================
+FSCK
+=======================
+*/
+
+/*
+	Walks the store from a root version: every version record must be there and parse, every
+	Kids stub must point at a version of the same node, every chunk must be there and hash to
+	its name, and a file's blocks must line up and add up to its size. It only reads the store,
+	so it works on a replica that isn't running (main -fsck) as well as on one that is (gofsctl
+	fsck). With repair, missing or damaged versions and chunks are fetched again from the peers;
+	a bad block layout can't be repaired, the version itself is wrong.
+
+	Version ids aren't checked against their records: one is the hash of the node before it got
+	the id (see GenerateVersionId), which can't be recomputed from the record, and the records
+	of upgraded stores keep their ids after the upgrade rewrote them (see prefixLegacyNodeIds).
+*/
+
+const (
+	FSCK_MISSING_VERSION = "missing version"
+	FSCK_BAD_VERSION = "unparseable version"
+	FSCK_BAD_STUB = "stub points at another node"
+	FSCK_MISSING_CHUNK = "missing chunk"
+	FSCK_CORRUPT_CHUNK = "corrupt chunk"
+	FSCK_BAD_LAYOUT = "bad block layout"
+)
+
+type FsckProblem struct {
+	Kind string
+	Path string
+	Id string		/* vid or chunk hash */
+	Detail string
+	Repaired bool
+}
+
+func (p FsckProblem) String() string {
+	s := fmt.Sprintf("%s: %s %s", p.Path, p.Kind, p.Id)
+	if p.Detail != "" {
+		s += " (" + p.Detail + ")"
+	}
+	if p.Repaired {
+		s += ", repaired"
+	}
+	return s
+}
+
+type FsckReport struct {
+	RootVid string
+	Nodes int
+	Chunks int
+	Problems []FsckProblem
+}
+
+/* true if every problem found was repaired */
+func (r FsckReport) Clean() bool {
+	for _, p := range r.Problems {
+		if !p.Repaired {
+			return false
+		}
+	}
+	return true
+}
+
+type checker struct {
+	repair bool
+	report FsckReport
+	seenVersions map[string]bool
+	seenChunks map[string]bool
+}
+
+/* checks the store from rootVid down, repairing from the peers if asked to */
+func Fsck(rootVid string, repair bool) FsckReport {
+	c := &checker{repair, FsckReport{rootVid, 0, 0, []FsckProblem{}}, make(map[string]bool), make(map[string]bool)}
+	if rootVid == "" {
+		/* nothing was ever written */
+		return c.report
+	}
+	c.checkVersion(rootVid, GetMyPid(), -1, "/")
+	storeLog.Info("fsck done", "vid", rootVid, "versions", c.report.Nodes, "chunks", c.report.Chunks, "problems", len(c.report.Problems))
+	return c.report
+}
+
+/* checks the filesystem of a running replica, as of now */
+func FsckOnline(fs *MyFS, repair bool) FsckReport {
+	lock.LOCK.Lock()
+	r, _ := fs.Root()
+	/* write back pending changes, so what is checked is what is in memory */
+	if err := writeBack(r.(*MyNode)); err != nil {
+		storeLog.Warn("fsck could not write back everything", "err", err)
+	}
+	rootVid := r.(*MyNode).Vid
+	lock.LOCK.Unlock()
+	return Fsck(rootVid, repair)
+}
+
+func (c *checker) problem(kind string, path string, id string, detail string, repaired bool) {
+	c.report.Problems = append(c.report.Problems, FsckProblem{kind, path, id, detail, repaired})
+}
+
+/* reads and parses a version record. nodeID is what the stub pointing at it says, -1 if nothing does */
+func (c *checker) loadVersion(vid string, lastWriter int, nodeID int, path string) (MyNode, bool) {
+	var node MyNode
+	nodestr, err := storage.Get([]byte(fmt.Sprintf("%s:%v", NODE_VERSION_KEY, vid)))
+	kind := ""
+	if err != nil {
+		/* versions from updates that were lost are only fetched when looked at */
+		if lastWriter != GetMyPid() && !isSubscribed(path) {
+			return node, false
+		}
+		kind = FSCK_MISSING_VERSION
+	} else if err = json.Unmarshal(nodestr, &node); err != nil {
+		kind = FSCK_BAD_VERSION
+	} else if node.Vid != vid {
+		kind = FSCK_BAD_VERSION
+		err = fmt.Errorf("record says it is %s", node.Vid)
+	}
+	if kind == "" {
+		return node, true
+	}
+
+	detail := ""
+	if err != nil && kind != FSCK_MISSING_VERSION {
+		detail = err.Error()
+	}
+	if c.repair {
+		fetched, err := PerformMetaDataRequest(trace.None, vid, lastWriter)
+		if err == nil && (nodeID < 0 || fetched.NodeID == nodeID) {
+			str, _ := json.Marshal(&fetched)
+			storage.Put([]byte(fmt.Sprintf("%s:%v", NODE_VERSION_KEY, vid)), str)
+			c.problem(kind, path, vid, detail, true)
+			return fetched, true
+		}
+	}
+	c.problem(kind, path, vid, detail, false)
+	return node, false
+}
+
+func (c *checker) checkVersion(vid string, lastWriter int, nodeID int, path string) {
+	if c.seenVersions[vid] {
+		return
+	}
+	c.seenVersions[vid] = true
+	c.report.Nodes++
+
+	node, ok := c.loadVersion(vid, lastWriter, nodeID, path)
+	if !ok {
+		return
+	}
+	if nodeID >= 0 && node.NodeID != nodeID {
+		c.problem(FSCK_BAD_STUB, path, vid, fmt.Sprintf("stub says node %d, version is of node %d", nodeID, node.NodeID), false)
+	}
+
+	if node.Attrib.Mode.IsDir() {
+		for name, stub := range node.Kids {
+			if stub == nil {
+				c.problem(FSCK_BAD_STUB, pathpkg.Join(path, name), "", "empty stub", false)
+				continue
+			}
+			c.checkVersion(stub.Vid, stub.LastWriter, stub.NodeID, pathpkg.Join(path, name))
+		}
+		return
+	}
+
+	c.checkLayout(node, path)
+	for _, hash := range node.DataBlocks {
+		c.checkChunk(hash, node.LastWriter, path)
+	}
+}
+
+/* blocks must be as many as their offsets and lengths, follow each other and add up to the size */
+func (c *checker) checkLayout(node MyNode, path string) {
+	if len(node.DataBlocks) != len(node.BlockOffsets) || len(node.DataBlocks) != len(node.BlockLengths) {
+		c.problem(FSCK_BAD_LAYOUT, path, node.Vid, fmt.Sprintf("%d blocks, %d offsets, %d lengths", len(node.DataBlocks), len(node.BlockOffsets), len(node.BlockLengths)), false)
+		return
+	}
+	off := 0
+	for i := range node.DataBlocks {
+		if node.BlockOffsets[i] != off {
+			c.problem(FSCK_BAD_LAYOUT, path, node.Vid, fmt.Sprintf("block %d starts at %d, expected %d", i, node.BlockOffsets[i], off), false)
+			return
+		}
+		off += node.BlockLengths[i]
+	}
+	if uint64(off) != node.Attrib.Size {
+		c.problem(FSCK_BAD_LAYOUT, path, node.Vid, fmt.Sprintf("blocks add up to %d bytes, size is %d", off, node.Attrib.Size), false)
+	}
+}
+
+func chunkMatches(hash string, data []byte) bool {
+	sum := sha1.Sum(data)
+	return hex.EncodeToString(sum[:]) == hash
+}
+
+func (c *checker) checkChunk(hash string, lastWriter int, path string) {
+	if c.seenChunks[hash] {
+		return
+	}
+	c.seenChunks[hash] = true
+	c.report.Chunks++
+
+	data, err := storage.Get([]byte(fmt.Sprintf("%s:%v", DATA_KEY, hash)))
+	kind := ""
+	if err != nil {
+		/* only the writer's copy is expected to be here, the others are fetched when needed */
+		if lastWriter != GetMyPid() && !isPinnedOrSubscribed(path) {
+			return
+		}
+		kind = FSCK_MISSING_CHUNK
+	} else if !chunkMatches(hash, data) {
+		kind = FSCK_CORRUPT_CHUNK
+	} else {
+		return
+	}
+
+	if c.repair {
+		fetched, err := PerformDataRequest(trace.None, hash, lastWriter)
+		if err == nil && chunkMatches(hash, fetched) {
+			storage.Put([]byte(fmt.Sprintf("%s:%v", DATA_KEY, hash)), fetched)
+			if lastWriter != GetMyPid() {
+				markCached(hash, path)
+			}
+			c.problem(kind, path, hash, "", true)
+			return
+		}
+	}
+	c.problem(kind, path, hash, "", false)
+}
+
+/* true if the chunks of path are supposed to be stored here even if someone else wrote them */
+func isPinnedOrSubscribed(path string) bool {
+	if _, found := pinOf(path); found {
+		return true
+	}
+	return isSubscribed(path)
+}
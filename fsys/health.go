@@ -0,0 +1,252 @@
+package fsys
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+======================
+PEER HEALTH
+=======================
+*/
+
+/*
+	Every replica publishes a heartbeat every HEARTBEAT_SECONDS. A heartbeat echoes back when the
+	sender last heard each of its peers' heartbeats and how long ago that was, which lets every
+	replica measure its round trip to each peer against its own clock. Anything received from a
+	peer counts as a sign of life; a failed request makes it suspect until it's heard from again.
+	A peer never heard from is suspect, and down once DOWN_AFTER has passed since this replica
+	started.
+*/
+
+const HEARTBEAT_SECONDS int = 2
+const SUSPECT_AFTER = 3 * time.Duration(HEARTBEAT_SECONDS) * time.Second
+const DOWN_AFTER = 15 * time.Second
+
+type PeerStatus int
+
+const (
+	PEER_UP PeerStatus = iota
+	PEER_SUSPECT
+	PEER_DOWN
+)
+
+func (s PeerStatus) String() string {
+	switch s {
+		case PEER_UP:
+			return "up"
+		case PEER_SUSPECT:
+			return "suspect"
+	}
+	return "down"
+}
+
+type PeerHealth struct {
+	Pid int
+	Name string
+	Status PeerStatus
+	LastSeen time.Time
+	RTT time.Duration
+}
+
+/* what a heartbeat echoes back about one peer's last heartbeat */
+type HeartbeatEcho struct {
+	SentAt time.Time
+	Held time.Duration
+}
+
+type peerRecord struct {
+	lastSeen time.Time
+	failedAt time.Time
+	rtt time.Duration
+
+	/* last heartbeat heard from this peer, echoed back in ours */
+	heardSentAt time.Time
+	heardAt time.Time
+}
+
+var peers map[int]*peerRecord
+var peersLock sync.Mutex
+
+/* when this replica started listening, the clock of peers never heard from */
+var healthStart time.Time
+
+func init() {
+	peers = make(map[int]*peerRecord)
+	healthStart = time.Now()
+}
+
+/* caller holds peersLock */
+func peerRecordFor(pid int) *peerRecord {
+	r, found := peers[pid]
+	if !found {
+		r = &peerRecord{}
+		peers[pid] = r
+	}
+	return r
+}
+
+/* last sign of life, or when this replica started if there was none yet. caller holds peersLock */
+func (r *peerRecord) heardOf() time.Time {
+	if r.lastSeen.IsZero() {
+		return healthStart
+	}
+	return r.lastSeen
+}
+
+/* caller holds peersLock */
+func (r *peerRecord) status(now time.Time) PeerStatus {
+	since := now.Sub(r.heardOf())
+	if since >= DOWN_AFTER {
+		return PEER_DOWN
+	}
+	if r.lastSeen.IsZero() || r.failedAt.After(r.lastSeen) || since >= SUSPECT_AFTER {
+		return PEER_SUSPECT
+	}
+	return PEER_UP
+}
+
+/* caller holds peersLock. smooths like TCP does */
+func (r *peerRecord) sampleRTT(rtt time.Duration) {
+	if r.rtt == 0 {
+		r.rtt = rtt
+	} else {
+		r.rtt = (7 * r.rtt + rtt) / 8
+	}
+}
+
+/* notes that something arrived from pid */
+func markSeen(pid int) {
+	if pid == Pid {
+		return
+	}
+	peersLock.Lock()
+	defer peersLock.Unlock()
+	peerRecordFor(pid).lastSeen = time.Now()
+}
+
+/* notes that a request to pid failed */
+func markFailed(pid int) {
+	peersLock.Lock()
+	defer peersLock.Unlock()
+	peerRecordFor(pid).failedAt = time.Now()
+	netLog.Debug("peer is suspect", "peer", pid)
+}
+
+/* notes how long a request to pid took */
+func markRTT(pid int, rtt time.Duration) {
+	peersLock.Lock()
+	defer peersLock.Unlock()
+	r := peerRecordFor(pid)
+	r.lastSeen = time.Now()
+	r.sampleRTT(rtt)
+}
+
+func receiveHeartbeat(msg Message) {
+	now := time.Now()
+	peersLock.Lock()
+	defer peersLock.Unlock()
+
+	r := peerRecordFor(msg.From)
+	r.lastSeen = now
+	r.heardSentAt = msg.SentAt
+	r.heardAt = now
+	if echo, found := msg.Echoes[Pid]; found && !echo.SentAt.IsZero() {
+		r.sampleRTT(now.Sub(echo.SentAt) - echo.Held)
+	}
+}
+
+func SendHeartbeat() {
+	now := time.Now()
+	m := Message{}
+	m.Type = HEARTBEAT
+	m.From = Pid
+	m.SentAt = now
+	m.Echoes = make(map[int]HeartbeatEcho)
+
+	peersLock.Lock()
+	for pid, r := range peers {
+		if !r.heardAt.IsZero() {
+			m.Echoes[pid] = HeartbeatEcho{r.heardSentAt, now.Sub(r.heardAt)}
+		}
+	}
+	peersLock.Unlock()
+
+	publish(m)
+}
+
+/* periodically publishes heartbeats until quit is closed */
+func StartHeartbeat(quit chan bool) {
+	go func() {
+		for {
+			select {
+				case <-quit:
+					return
+				case <-time.After(time.Duration(HEARTBEAT_SECONDS) * time.Second):
+					SendHeartbeat()
+			}
+		}
+	}()
+}
+
+func GetPeerStatus(pid int) PeerStatus {
+	peersLock.Lock()
+	defer peersLock.Unlock()
+	return peerRecordFor(pid).status(time.Now())
+}
+
+/* how long pid has been down, 0 if it isn't */
+func downFor(pid int) time.Duration {
+	peersLock.Lock()
+	defer peersLock.Unlock()
+	r := peerRecordFor(pid)
+	now := time.Now()
+	if r.status(now) != PEER_DOWN {
+		return 0
+	}
+	return now.Sub(r.heardOf()) - DOWN_AFTER
+}
+
+/* health of every current member other than self */
+func GetPeerHealth() []PeerHealth {
+	now := time.Now()
+	list := []PeerHealth{}
+	for _, m := range GetPeers() {
+		peersLock.Lock()
+		r := peerRecordFor(m.Pid)
+		list = append(list, PeerHealth{m.Pid, m.Name, r.status(now), r.lastSeen, r.rtt})
+		peersLock.Unlock()
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Pid < list[j].Pid })
+	return list
+}
+
+/*
+	Peers to ask for something last written by `preferred`: the writer itself first, then the
+	others (which may have fetched it since), healthiest and closest first. Down peers are skipped.
+*/
+func requestCandidates(preferred int) []int {
+	health := GetPeerHealth()
+	sort.SliceStable(health, func(i, j int) bool {
+		if health[i].Status != health[j].Status {
+			return health[i].Status < health[j].Status
+		}
+		return health[i].RTT < health[j].RTT
+	})
+
+	candidates := []int{}
+	for _, h := range health {
+		if h.Status == PEER_DOWN {
+			netLog.Debug("skipping peer, it is down", "peer", h.Pid, "name", h.Name)
+			continue
+		}
+		if h.Pid == preferred {
+			candidates = append([]int{h.Pid}, candidates...)
+		} else {
+			candidates = append(candidates, h.Pid)
+		}
+	}
+	return candidates
+}
@@ -0,0 +1,90 @@
+package fsys
+
+import (
+	"os"
+	"fmt"
+	"errors"
+	"strings"
+	"p4/lock"
+	"p4/trace"
+)
+
+/*
+======================
+HISTORY
+=======================
+*/
+
+/*
+	Every file has a hidden read-only directory next to it, name.history, listing every version
+	of the file this replica knows of, the ones written by peers included. Entries are named
+	<mtime>.<writer>.<vid>, so they sort by time and keep their name for good; their size and
+	mtime are those of the version, and reading one reads that version. The vid is what
+	RESTORE_XATTR takes.
+*/
+
+const HISTORY_SUFFIX string = ".history"
+
+/* name of the history entry of a version */
+func historyEntryName(v *MyNode) string {
+	return fmt.Sprintf("%s.%s.%s", v.Attrib.Mtime.UTC().Format("2006-01-02T15:04:05"), writerName(v.LastWriter), v.Vid)
+}
+
+/* the history directory of the file called name in p, nil if there is no such file. caller holds lock.LOCK */
+func historyDir(p *MyNode, name string) *MyNode {
+	f, found := p.children[name]
+	if !found || f.Attrib.Mode.IsDir() || p.archive {
+		return nil
+	}
+
+	/* built afresh on every lookup: its inode comes from p's and its name, so it stays the same */
+	h := newVirtualDir(name + HISTORY_SUFFIX, os.ModeDir|0555, p)
+	h.Attrib.Mtime = f.Attrib.Mtime
+	for _, v := range nodeVersions(f) {
+		v.Name = historyEntryName(v)
+		v.Attrib.Mode = v.Attrib.Mode & 0444
+		v.Attrib.Inode = versionInode(v.Vid)
+		v.parent = h
+		h.children[v.Name] = v
+	}
+	return h
+}
+
+/* every known version of a node, oldest first */
+func nodeVersions(n *MyNode) []*MyNode {
+	versions := []*MyNode{}
+	for _, vid := range GetNodeVersions(n.NodeID) {
+		/* every listed version is stored locally, but ask around rather than give up */
+		v, err := LoadNodeVersion(trace.None, vid, -1)
+		if err != nil || v.Vid != vid {
+			fuseLog.Warn("version is missing", "node", n.Name, "vid", vid, "err", err)
+			continue
+		}
+		versions = append(versions, v)
+	}
+	return versions
+}
+
+/* every known version of the node at path, oldest first */
+func GetVersions(fs *MyFS, path string) ([]*MyNode, error) {
+	lock.LOCK.Lock()
+	defer lock.LOCK.Unlock()
+	n := lookupPath(fs, path)
+	if n == nil {
+		return nil, errors.New(path + " does not exist")
+	}
+	return nodeVersions(n), nil
+}
+
+/* name of the member that wrote a version */
+func writerName(pid int) string {
+	if m, found := GetMember(pid); found {
+		return m.Name
+	}
+	return fmt.Sprintf("%d", pid)
+}
+
+/* true if name looks like a history directory */
+func isHistoryName(name string) bool {
+	return strings.HasSuffix(name, HISTORY_SUFFIX) && len(name) > len(HISTORY_SUFFIX)
+}
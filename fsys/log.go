@@ -0,0 +1,11 @@
+package fsys
+
+import (
+	"p4/util"
+)
+
+/* one logger per subsystem (see util.Logger), so each can be turned up on its own */
+var fuseLog = util.Logger(util.LOG_FUSE)
+var flushLog = util.Logger(util.LOG_FLUSHER)
+var netLog = util.Logger(util.LOG_NETWORK)
+var storeLog = util.Logger(util.LOG_STORAGE)
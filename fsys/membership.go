@@ -0,0 +1,230 @@
+package fsys
+
+import (
+	"time"
+	"sync"
+	"errors"
+	"encoding/json"
+	"p4/storage"
+	"p4/util"
+)
+
+/*
+======================
+MEMBERSHIP
+=======================
+*/
+
+/*
+	The member list starts out as the entries of config.txt and changes at runtime: a new replica
+	joins through any member's REP socket, everyone periodically gossips the list over PUB, and a
+	replica that shuts down gossips itself as having left. Each member owns its entry and bumps
+	its Incarnation whenever the entry changes, so the highest incarnation always wins.
+*/
+
+const MEMBERS_KEY string = "MEMBERS"
+
+/* how often the member list is gossiped */
+const GOSSIP_SECONDS int = 10
+
+type Member struct {
+	Pid int
+	Name string
+	Address util.Endpoint
+	PublicKey string	/* curve key, empty when authentication is off */
+	Incarnation uint64
+	Left bool
+}
+
+var members map[int]Member
+var membersLock sync.Mutex
+
+/* loads the persisted member list, adds the config file entries and announces self */
+func InitMembership() {
+	membersLock.Lock()
+	defer membersLock.Unlock()
+
+	members = make(map[int]Member)
+	memberstr, err := storage.Get([]byte(MEMBERS_KEY))
+	if err == nil {
+		var list []Member
+		json.Unmarshal(memberstr, &list)
+		for _, m := range list {
+			members[m.Pid] = m
+		}
+	}
+
+	for _, e := range util.ReadAllConfigEntries() {
+		if _, found := members[e.Pid]; !found {
+			members[e.Pid] = Member{e.Pid, e.Name, e.HostAddress, e.PublicKey, 0, false}
+		}
+	}
+
+	self := members[Pid]
+	key := self.PublicKey
+	for _, e := range util.ReadAllConfigEntries() {
+		if e.Pid == Pid {
+			key = e.PublicKey
+		}
+	}
+	members[Pid] = Member{Pid, ServerName, HostAddress, key, self.Incarnation + 1, false}
+	saveMembers()
+}
+
+/* caller holds membersLock */
+func saveMembers() {
+	list := make([]Member, 0, len(members))
+	for _, m := range members {
+		list = append(list, m)
+	}
+	memberstr, _ := json.Marshal(list)
+	storage.Put([]byte(MEMBERS_KEY), memberstr)
+}
+
+/* every member ever heard of, including those that left */
+func GetAllMembers() []Member {
+	membersLock.Lock()
+	defer membersLock.Unlock()
+	list := make([]Member, 0, len(members))
+	for _, m := range members {
+		list = append(list, m)
+	}
+	return list
+}
+
+/* members that haven't left, not including self */
+func GetPeers() []Member {
+	membersLock.Lock()
+	defer membersLock.Unlock()
+	list := make([]Member, 0, len(members))
+	for _, m := range members {
+		if m.Pid != Pid && !m.Left {
+			list = append(list, m)
+		}
+	}
+	return list
+}
+
+func GetMember(pid int) (Member, bool) {
+	membersLock.Lock()
+	defer membersLock.Unlock()
+	m, found := members[pid]
+	return m, found
+}
+
+func GetEndpointFromPid(pid int) util.Endpoint {
+	m, _ := GetMember(pid)
+	return m.Address
+}
+
+/* folds a list received from a peer into the local one. returns true if anything changed */
+func MergeMembers(list []Member) bool {
+	membersLock.Lock()
+	defer membersLock.Unlock()
+
+	changed := false
+	for _, m := range list {
+		if m.Pid == Pid {
+			/* nobody else gets to say we left; refute it */
+			if self := members[Pid]; m.Left && !self.Left && m.Incarnation >= self.Incarnation {
+				self.Incarnation = m.Incarnation + 1
+				members[Pid] = self
+				changed = true
+			}
+			continue
+		}
+		existing, found := members[m.Pid]
+		if !found || m.Incarnation > existing.Incarnation {
+			netLog.Info("member", "peer", m.Pid, "name", m.Name, "addr", m.Address.String(), "left", m.Left)
+			members[m.Pid] = m
+			allowMember(m)
+			changed = true
+		}
+	}
+	if changed {
+		saveMembers()
+	}
+	return changed
+}
+
+/* asks an existing member (addressed by its PUB endpoint) to let us in, and adopts its member list */
+func JoinCluster(seed util.Endpoint) error {
+	self, _ := GetMember(Pid)
+	m := Message{}
+	m.Type = JOIN_REQUEST
+	m.From = Pid
+	m.Members = []Member{self}
+	reply, err := sendRequest(m, seed)
+	if err != nil {
+		return err
+	}
+	if reply.Type != JOIN_REPLY {
+		return errors.New("join request refused")
+	}
+	MergeMembers(reply.Members)
+	netLog.Info("joined", "seed", seed.String(), "members", len(reply.Members))
+	return nil
+}
+
+/* announces that this replica is going away */
+func LeaveCluster() {
+	membersLock.Lock()
+	self := members[Pid]
+	self.Incarnation++
+	self.Left = true
+	members[Pid] = self
+	saveMembers()
+	membersLock.Unlock()
+
+	SendGossip()
+}
+
+/* periodically gossips the member list until quit is closed */
+func StartGossip(quit chan bool) {
+	go func() {
+		for {
+			select {
+				case <-quit:
+					return
+				case <-time.After(time.Duration(GOSSIP_SECONDS) * time.Second):
+					SendGossip()
+			}
+		}
+	}()
+}
+
+/*
+	Subscriptions to member PUB sockets. Only touched by the SUB goroutine, since subscribers
+	aren't safe for concurrent use; it calls syncSubscriptions between receives.
+*/
+var subscribedTo map[int]util.Endpoint
+
+func syncSubscriptions(fs *MyFS) {
+	if subscribedTo == nil {
+		subscribedTo = make(map[int]util.Endpoint)
+	}
+	wanted := make(map[int]util.Endpoint)
+	for _, m := range GetPeers() {
+		wanted[m.Pid] = m.Address
+	}
+
+	for pid, addr := range subscribedTo {
+		if w, found := wanted[pid]; !found || w != addr {
+			netLog.Debug("disconnecting", "peer", pid, "addr", addr.String())
+			SubSocket.Disconnect(addr.String())
+			delete(subscribedTo, pid)
+		}
+	}
+	for pid, addr := range wanted {
+		if _, found := subscribedTo[pid]; !found {
+			netLog.Debug("connecting", "peer", pid, "addr", addr.String())
+			if err := SubSocket.Connect(addr.String()); err != nil {
+				netLog.Warn("not subscribing", "peer", pid, "err", err)
+				continue
+			}
+			subscribedTo[pid] = addr
+			/* pick up whatever it published while we weren't listening */
+			startCatchUp(pid, fs)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package fsys
+
+import (
+	"time"
+	"testing"
+	"encoding/json"
+)
+
+func isPeer(pid int) bool {
+	for _, m := range GetPeers() {
+		if m.Pid == pid {
+			return true
+		}
+	}
+	return false
+}
+
+func TestMembershipJoinAndLeave(t *testing.T) {
+	fs := startTestReplica(t)
+	two := newTestPeer(t, 2)
+	three := newTestPeer(t, 3)
+
+	/* a new replica joins through this one and learns who is there */
+	reply := two.request(t, Message{Type: JOIN_REQUEST, Members: []Member{two.member}})
+	if reply.Type != JOIN_REPLY {
+		t.Fatalf("reply %d to a join, want JOIN_REPLY", reply.Type)
+	}
+	known := make(map[int]bool)
+	for _, m := range reply.Members {
+		known[m.Pid] = true
+	}
+	if !known[1] || !known[2] {
+		t.Errorf("join reply lists %v, want 1 and 2", known)
+	}
+	if !isPeer(2) {
+		t.Error("the joining replica isn't a peer")
+	}
+
+	/* joining through a seed adopts the members it knows */
+	two.lock.Lock()
+	two.members = []Member{two.member, three.member}
+	two.lock.Unlock()
+	if err := JoinCluster(two.member.Address); err != nil {
+		t.Fatalf("join: %v", err)
+	}
+	if !isPeer(3) {
+		t.Error("a member the seed knows wasn't adopted")
+	}
+
+	/* a member gossiped as gone stops being a peer */
+	startTestSub(t, fs, two)
+	left := two.member
+	left.Incarnation++
+	left.Left = true
+	two.publish(Message{Type: MEMBERSHIP_GOSSIP, Members: []Member{left}})
+	eventually(t, "peer 2 has left", func() bool { return !isPeer(2) })
+	if !isPeer(3) {
+		t.Error("peer 3 went along with peer 2")
+	}
+
+	/* and leaving is gossiped to the others */
+	sub, _ := Net.NewSubscriber()
+	defer sub.Close()
+	sub.Connect(HostAddress.String())
+	sub.Subscribe([]byte{})
+	LeaveCluster()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		frame, _, err := sub.Recv(time.Second)
+		if err != nil {
+			continue
+		}
+		_, body := splitFrame(frame)
+		var msg Message
+		json.Unmarshal(body, &msg)
+		if msg.Type != MEMBERSHIP_GOSSIP {
+			continue
+		}
+		for _, m := range msg.Members {
+			if m.Pid == 1 && m.Left {
+				return
+			}
+		}
+	}
+	t.Error("leaving wasn't gossiped")
+}
+
+/* nobody else gets to say a replica left */
+func TestMembershipRefutesLeaving(t *testing.T) {
+	startTestReplica(t)
+	self, _ := GetMember(1)
+	rumour := self
+	rumour.Left = true
+	MergeMembers([]Member{rumour})
+	if now, _ := GetMember(1); now.Left || now.Incarnation <= rumour.Incarnation {
+		t.Errorf("after a rumour of leaving at incarnation %d: %+v", rumour.Incarnation, now)
+	}
+}
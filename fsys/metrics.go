@@ -0,0 +1,119 @@
+package fsys
+
+import (
+	"net"
+	"sync"
+	"time"
+	"strings"
+	"p4/metrics"
+	"p4/storage"
+	"p4/util"
+)
+
+/*
+======================
+METRICS
+=======================
+*/
+
+/* how long a scan of the store for its size is reused. scanning reads every record */
+const STORAGE_SCAN_SECONDS int = 60
+
+/* peer label of published messages, which go to every subscriber at once */
+const BROADCAST_PEER string = "broadcast"
+
+var (
+	fuseOpSeconds = metrics.NewHistogram("gofs_fuse_op_duration_seconds", "Time spent in each FUSE handler, lock wait included.", nil, "op")
+	flushSeconds = metrics.NewHistogram("gofs_flush_duration_seconds", "Time to write back and publish dirty nodes.", nil)
+	dirtyNodes = metrics.NewGauge("gofs_dirty_nodes", "Nodes changed but not published yet.")
+	messagesSent = metrics.NewCounter("gofs_messages_sent_total", "Messages sent, by peer.", "peer")
+	bytesSent = metrics.NewCounter("gofs_bytes_sent_total", "Bytes of messages sent, by peer.", "peer")
+	messagesReceived = metrics.NewCounter("gofs_messages_received_total", "Messages received, by peer.", "peer")
+	bytesReceived = metrics.NewCounter("gofs_bytes_received_total", "Bytes of messages received, by peer.", "peer")
+	chunkLoads = metrics.NewCounter("gofs_chunk_loads_total", "Chunks loaded, by whether they were stored here (hit) or fetched from a peer (miss).", "result")
+	cachedNodes = metrics.NewGauge("gofs_cached_nodes", "Expanded nodes held in memory, as of the last eviction.")
+	cachedBytes = metrics.NewGauge("gofs_cached_bytes", "Estimated memory held by expanded nodes, as of the last eviction.")
+	cacheEvictions = metrics.NewCounter("gofs_cache_evictions_total", "Nodes collapsed to free memory, by kind (file or dir).", "kind")
+)
+
+func init() {
+	metrics.NewGaugeFunc("gofs_storage_bytes", "Size of the keys and values in the store, by key namespace.", func() []metrics.Sample {
+		return storageSamples(false)
+	}, "namespace")
+	metrics.NewGaugeFunc("gofs_storage_keys", "Number of keys in the store, by key namespace.", func() []metrics.Sample {
+		return storageSamples(true)
+	}, "namespace")
+}
+
+/* the metrics HTTP server, closed by Close */
+var metricsListener net.Listener
+
+/* serves /metrics on addr (host:port) */
+func StartMetrics(addr string) error {
+	var err error
+	metricsListener, err = metrics.Serve(addr)
+	if err == nil {
+		netLog.Info("serving metrics", "url", "http://" + addr + "/metrics")
+	}
+	return err
+}
+
+/* records a FUSE operation started at start. use as: defer observeOp("read", time.Now()) */
+func observeOp(op string, start time.Time) {
+	fuseOpSeconds.Observe(time.Since(start).Seconds(), op)
+}
+
+/* counts a message going to or coming from a peer */
+func countSent(peer string, size int) {
+	messagesSent.Inc(peer)
+	bytesSent.Add(float64(size), peer)
+}
+
+func countReceived(peer string, size int) {
+	messagesReceived.Inc(peer)
+	bytesReceived.Add(float64(size), peer)
+}
+
+/* the label of the member listening at dest, its address if it isn't a member (yet) */
+func peerName(dest util.Endpoint) string {
+	for _, m := range GetAllMembers() {
+		if m.Address == dest {
+			return m.Name
+		}
+	}
+	return dest.String()
+}
+
+/* size of the store by namespace, the part of a key before its first ':' */
+var storageScan struct {
+	lock sync.Mutex
+	at time.Time
+	bytes map[string]float64
+	keys map[string]float64
+}
+
+func storageSamples(keys bool) []metrics.Sample {
+	storageScan.lock.Lock()
+	defer storageScan.lock.Unlock()
+	if time.Since(storageScan.at) > time.Duration(STORAGE_SCAN_SECONDS) * time.Second {
+		storageScan.bytes = make(map[string]float64)
+		storageScan.keys = make(map[string]float64)
+		storage.Iterate([]byte{}, func(key []byte, val []byte) bool {
+			ns := strings.SplitN(string(key), ":", 2)[0]
+			storageScan.bytes[ns] += float64(len(key) + len(val))
+			storageScan.keys[ns]++
+			return true
+		})
+		storageScan.at = time.Now()
+	}
+
+	from := storageScan.bytes
+	if keys {
+		from = storageScan.keys
+	}
+	samples := []metrics.Sample{}
+	for ns, v := range from {
+		samples = append(samples, metrics.Sample{LabelValues: []string{ns}, Value: v})
+	}
+	return samples
+}
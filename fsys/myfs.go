@@ -12,6 +12,9 @@ FILESYSTEM
 */
 
 
+/* a read-only replica follows and serves the filesystem but never changes it, so it never publishes. it can pin subtrees, they stay local */
+var ReadOnly bool
+
 /* define custom filesystem with RootDir and Pid */
 type MyFS struct{
 	RootDir *MyNode
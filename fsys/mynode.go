@@ -7,10 +7,11 @@ import (
 	"fmt"
 	"time"
 	"strings"
+	"strconv"
 	"syscall"
 	"p4/lock"
-	"p4/util"
 	"p4/storage"
+	"p4/trace"
 )
 
 /*
@@ -59,6 +60,9 @@ type MyNode struct {
 
 	LastWriter int
 
+	/* replication factor of the subtree, 0 to inherit it (see replication.go) */
+	Replicas int
+
 	data []byte
 
 	/* For now, BlockOffsets and BlockLengths are exported fields in the MyNode structure. Can change later if required. */
@@ -84,24 +88,25 @@ func (n *MyNode) String() string {
 
 
 func (n *MyNode) checkForUpdates() bool {
-	updatenode, found := hash2mynode[n.Vid]
+	path := nodePath(n)
+	updatenode, found := hash2mynode[path]
 	if found {
 		n.updateFromNode(updatenode)
-		util.P_out("found update to %s!", n.Name)
-		delete(hash2mynode, n.Vid)
+		fuseLog.Debug("found update", "node", n.Name, "vid", n.Vid)
+		delete(hash2mynode, path)
 		return true
 	}
 	return false
 }
 
 func (n *MyNode) updateFromNode(val MyNode) {
-	AssertExpanded(n)
 	if n.Attrib.Mode.IsDir() {
 		n.Vid = val.Vid
 		n.Name = val.Name
 		n.Attrib = val.Attrib
 		n.LastWriter = val.LastWriter
 		n.Kids = val.Kids
+		n.Replicas = val.Replicas
 		n.expanded = false
 	} else {
 		n.Vid = val.Vid
@@ -111,20 +116,26 @@ func (n *MyNode) updateFromNode(val MyNode) {
 		n.BlockLengths = val.BlockLengths
 		n.DataBlocks = val.DataBlocks
 		n.LastWriter = val.LastWriter
+		n.Replicas = val.Replicas
 		n.data = []byte{}
 		n.expanded = false
 	}
 }
 
-func (n *MyNode) WriteBackData() {
-	AssertExpanded(n)
+func (n *MyNode) WriteBackData() error {
+	if err := AssertExpanded(trace.None, n); err != nil {
+		return err
+	}
 	// if im a file, write out my data blocks and hashes
 	for i := 0; i < len(n.DataBlocks); i++ {
 		str := n.DataBlocks[i]
 		off := n.BlockOffsets[i]
 		ret := n.BlockLengths[i]
 		storage.Put([]byte(fmt.Sprintf("%s:%v", DATA_KEY, str)), n.data[off:off + ret])
+		/* the chunk may have been fetched before, but it's ours now and must not be collected */
+		storage.Delete([]byte(fmt.Sprintf("%s:%s", CACHED_KEY, str)))
 	}
+	return nil
 }
 
 
@@ -142,7 +153,7 @@ func (n *MyNode) Init(name string, mode os.FileMode, parent *MyNode) {
 
 	n.NodeID = GetAvailableUid()
 
-	n.Attrib.Inode = GetAvailableInode()
+	n.Attrib.Inode = nodeInode(n.NodeID)
 	n.Attrib.Nlink = 1
 	n.Name = name
 
@@ -170,58 +181,170 @@ func (n *MyNode) Init(name string, mode os.FileMode, parent *MyNode) {
 	n.LastWriter = GetMyPid()
 }
 
+/* a read-only directory listing old versions, outside the tree: it takes no node id and is never written back */
+func newVirtualDir(name string, mode os.FileMode, parent *MyNode) *MyNode {
+	d := new(MyNode)
+	d.Name = name
+	d.Attrib.Nlink = 1
+	tm := time.Now()
+	d.Attrib.Atime = tm
+	d.Attrib.Mtime = tm
+	d.Attrib.Ctime = tm
+	d.Attrib.Crtime = tm
+	d.Attrib.Mode = mode
+	d.Attrib.Gid = uint32(os.Getegid())
+	d.Attrib.Uid = uint32(os.Geteuid())
+	d.parent = parent
+	d.children = make(map[string]*MyNode)
+	d.Kids = make(map[string]*Stub)
+	d.LastWriter = GetMyPid()
+	d.archive = true
+	d.expanded = true
+	return d
+}
+
 /* An Attr method to return the basic file attributes defined by Attr. Required to implement Node interface */
 func (n *MyNode) Attr() fuse.Attr {
+	op := startOp("attr", n)
+	defer op.end()
+	lock.LOCK.Lock()
+	defer lock.LOCK.Unlock()
 	n.checkForUpdates()
-	util.P_out("|%s| attr.Mode = %v", n.Name, n.Attrib)
-	return n.Attrib
+	fuseLog.Debug("attr", "node", n.Name, "mode", n.Attrib.Mode)
+	attr := n.Attrib
+	attr.Inode = n.inode()
+	return attr
 }
 
 /* checks whether a child with name `name` exists */
 func (n *MyNode) Lookup(name string, intr fs.Intr) (fs.Node, fuse.Error) {
-	util.P_out("LOOKUP: %s in %s", name, n.Name)
+	op := startOp("lookup", n)
+	defer op.end()
+	/* the node may be collapsed under us otherwise, see evictNodes */
+	lock.LOCK.Lock()
+	defer lock.LOCK.Unlock()
+	fuseLog.Debug("lookup", "node", n.Name, "name", name)
 	n.checkForUpdates()
-	AssertExpanded(n)
+	if err := AssertExpanded(op.context(), n); err != nil {
+		return nil, fuseError(err)
+	}
+	if n.parent == nil && name == SNAPSHOTS_DIR {
+		return getSnapshotsDir(n), nil
+	}
+	if n == snapshotsDir {
+		refreshSnapshotsDir()
+	}
 	if k, ok := n.children[name]; ok {
 		return k, nil
 	}
+	if isHistoryName(name) {
+		if h := historyDir(n, strings.TrimSuffix(name, HISTORY_SUFFIX)); h != nil {
+			return h, nil
+		}
+	}
 	return nil, fuse.ENOENT
 }
 
 /* reads directory. */
 func (n *MyNode) ReadDir(intr fs.Intr) ([]fuse.Dirent, fuse.Error) {
+	op := startOp("readdir", n)
+	defer op.end()
 	lock.LOCK.Lock()
 	defer lock.LOCK.Unlock()
 	n.checkForUpdates()
-	AssertExpanded(n)
-	util.P_out("performing a readdir on %v", n)
+	if err := AssertExpanded(op.context(), n); err != nil {
+		return nil, fuseError(err)
+	}
+	defer evictNodes()
+	fuseLog.Debug("readdir", "node", n.Name, "vid", n.Vid)
 	dirs := make([]fuse.Dirent, 0, 10)
+	if n.parent == nil {
+		d := getSnapshotsDir(n)
+		dirs = append(dirs, fuse.Dirent{Inode: d.inode(), Name: SNAPSHOTS_DIR, Type: fuse.DT_Dir})
+	}
+	if n == snapshotsDir {
+		refreshSnapshotsDir()
+	}
 	for k, v := range n.children {
-		d := fuse.Dirent{Inode: v.Attrib.Inode, Name: k, Type: v.fuseType()}
-		util.P_out("readdir %s => %v", k, d)
+		d := fuse.Dirent{Inode: v.inode(), Name: k, Type: v.fuseType()}
 		dirs = append(dirs, d)
 	}
 	return dirs, nil
 }
 
-/* must be defined or editing w/ vi or emacs fails. Doesn't have to do anything */
+/*
+	The kernel dropped the node. One that isn't in the tree any more (removed, or left behind
+	when its directory was collapsed) can't be reached again, so its memory goes now.
+*/
+func (n *MyNode) Forget() {
+	op := startOp("forget", n)
+	defer op.end()
+	lock.LOCK.Lock()
+	defer lock.LOCK.Unlock()
+	/* history directories are built on every lookup and forgotten like nodes that were removed */
+	if n.parent == nil || n.parent.children[n.Name] == n || n.dirty {
+		return
+	}
+	fuseLog.Debug("forgotten", "node", n.Name, "vid", n.Vid)
+	dropNode(n)
+}
+
+/*
+	must be defined or editing w/ vi or emacs fails. Once it returns, the node and every
+	directory up to the root are written back (writeBackPath) and the store is synced to disk
+	(storage.Sync), so they survive a crash. Peers get them with the next flush, as usual.
+*/
 func (n *MyNode) Fsync(req *fuse.FsyncRequest, intr fs.Intr) fuse.Error {
+	op := startOp("fsync", n)
+	defer op.end()
 	lock.LOCK.Lock()
 	defer lock.LOCK.Unlock()
+	if err := writeBackPath(n); err != nil {
+		return fuseError(err)
+	}
+	if err := storage.Sync(); err != nil {
+		fuseLog.Error("fsync failed", "node", n.Name, "err", err)
+		return fuse.EIO
+	}
+	requestFlush()
 	return nil
 }
 
 /* creates a directory */
 func (p *MyNode) Mkdir(req *fuse.MkdirRequest, intr fs.Intr) (fs.Node, fuse.Error) {
+	op := startOp("mkdir", p)
+	defer op.end()
+	if ReadOnly {
+		return nil, fuse.Errno(syscall.EROFS)
+	}
 	lock.LOCK.Lock()
 	defer lock.LOCK.Unlock()
 	p.checkForUpdates()
-	AssertExpanded(p)
+	if err := AssertExpanded(op.context(), p); err != nil {
+		return nil, fuseError(err)
+	}
+
+	if p == snapshotsDir {
+		/* mkdir /.snapshots/<name> takes a snapshot of everything */
+		if _, err := createSnapshot(p.parent, req.Name, "/"); err != nil {
+			fuseLog.Warn("snapshot failed", "name", req.Name, "err", err)
+			return nil, fuse.Errno(syscall.EINVAL)
+		}
+		refreshSnapshotsDir()
+		if d, found := p.children[req.Name]; found {
+			return d, nil
+		}
+		return nil, fuse.EIO
+	}
 
 	if !isAllowed(p, "w") {
 		return nil, fuse.Errno(syscall.EACCES)
 	}
 
+	if p.parent == nil && req.Name == SNAPSHOTS_DIR {
+		return nil, fuse.Errno(syscall.EEXIST)
+	}
+
 	if strings.Contains(req.Name, "@") {
 		tokens := strings.Split(req.Name, "@")
 		filename := tokens[0]
@@ -233,14 +356,20 @@ func (p *MyNode) Mkdir(req *fuse.MkdirRequest, intr fs.Intr) (fs.Node, fuse.Erro
 		if !found {
 			/* if it has been deleted, look at old versions of the parent to see if we can find it */
 			/* NOTE: currently, even if the node has been moved somewhere else, this will still allow the archive to be created */
-			util.P_out("looking through old versions of parent")
+			fuseLog.Debug("looking through old versions of parent", "node", p.Name)
 			parentVersions := GetNodeVersions(p.NodeID)
 			for i := len(parentVersions) - 1; i >= 0; i-- {
-				vnode, _ := LoadNodeVersion(parentVersions[i], GetMyPid())
-				vid, err := vnode.Kids[filename]
-				if err {
+				vnode, err := LoadNodeVersion(op.context(), parentVersions[i], GetMyPid())
+				if err != nil {
+					continue
+				}
+				vid, found := vnode.Kids[filename]
+				if found {
 					/* version found */
-					n, _ = LoadNodeVersion(vid.Vid, GetMyPid())
+					n, err = LoadNodeVersion(op.context(), vid.Vid, vid.LastWriter)
+					if err != nil {
+						return nil, fuseError(err)
+					}
 					break
 				}
 			}
@@ -255,11 +384,14 @@ func (p *MyNode) Mkdir(req *fuse.MkdirRequest, intr fs.Intr) (fs.Node, fuse.Erro
 		if n.Attrib.Mode.IsDir() {
 			date := tokens[1]
 			finalTime := parseTime(date)
-			util.P_out("final time: %v", finalTime)
+			fuseLog.Debug("archive", "node", n.Name, "time", finalTime)
 			versions := GetNodeVersions(n.NodeID)
 			var prev *MyNode = nil
 			for i := 0; i < len(versions); i++ {
-				vnode, _ := LoadNodeVersion(versions[i], GetMyPid())
+				vnode, err := LoadNodeVersion(op.context(), versions[i], GetMyPid())
+				if err != nil {
+					return nil, fuseError(err)
+				}
 				if vnode.Attrib.Mtime.Before(finalTime) {
 					prev = vnode
 				} else {
@@ -268,33 +400,32 @@ func (p *MyNode) Mkdir(req *fuse.MkdirRequest, intr fs.Intr) (fs.Node, fuse.Erro
 			}
 			if prev != nil {
 				/* copy all of prev's children into d */
-				d := new(MyNode)
-				d.Init(req.Name, os.ModeDir|0555, p)
+				d := newVirtualDir(req.Name, os.ModeDir|0555, p)
+				/* the children are loaded from prev's stubs when first looked at */
+				d.expanded = false
 				p.children[req.Name] = d
 				for k, v := range prev.Kids {
 					d.Kids[k] = v
 				}
-				util.P_out("state of children: %v", d.Kids)
-				d.archive = true
 				return d, nil
 			} else {
 				/* trying to get a version from before the folder was actually created */
 				return nil, fuse.EPERM
 			}
 		} else {
-			d := new(MyNode)
-			d.Init(req.Name, os.ModeDir|0444, p)
+			d := newVirtualDir(req.Name, os.ModeDir|0444, p)
 			p.children[req.Name] = d
 			versions := GetNodeVersions(n.NodeID)
 			for i := 0; i < len(versions); i++ {
-				vnode, _ := LoadNodeVersion(versions[i], GetMyPid())
+				vnode, err := LoadNodeVersion(op.context(), versions[i], GetMyPid())
+				if err != nil {
+					/* leave out what can't be loaded right now */
+					continue
+				}
 				vnode.Name = vnode.Name + ".[" + vnode.Attrib.Mtime.Format("Mon Jan 2 15:04:05 -0700 MST 2006") + "]"
 				vnode.Attrib.Mode = vnode.Attrib.Mode & 0444;	/* make it read-only */
-				util.P_out("vnode: %v", vnode.Attrib.Mtime)
 				d.children[vnode.Name] = vnode
 			}
-			d.expanded = true
-			d.archive = true
 			return d, nil
 		}
 
@@ -319,59 +450,81 @@ func (p *MyNode) Mkdir(req *fuse.MkdirRequest, intr fs.Intr) (fs.Node, fuse.Erro
 
 /* creates a file */
 func (p *MyNode) Create(req *fuse.CreateRequest, resp *fuse.CreateResponse, intr fs.Intr) (fs.Node, fs.Handle, fuse.Error) {
+	op := startOp("create", p)
+	defer op.end()
+	if ReadOnly {
+		return nil, nil, fuse.Errno(syscall.EROFS)
+	}
 	lock.LOCK.Lock()
 	defer lock.LOCK.Unlock()
-	util.P_out("CREATE %s in %s", req.Name, p.Name)
+	fuseLog.Debug("create", "node", p.Name, "name", req.Name, "mode", req.Mode)
 	p.checkForUpdates()
-	AssertExpanded(p)
-	fmt.Println(req)
+	if err := AssertExpanded(op.context(), p); err != nil {
+		return nil, nil, fuseError(err)
+	}
 	if !isAllowed(p, "w") {
 		return nil, nil, fuse.Errno(syscall.EACCES)
 	}
+	if p.parent == nil && req.Name == SNAPSHOTS_DIR {
+		return nil, nil, fuse.Errno(syscall.EEXIST)
+	}
 	f := new(MyNode)
 	f.Init(req.Name, req.Mode, p)
 	p.children[req.Name] = f
 	updateAncestors(f)
-	util.P_out("Create: %s => %v, %v", req.Name, f.Attrib.Mode.Perm(), req.Mode.Perm())
 	return f, f, nil
 }
 
 /* removes a file */
 func (p *MyNode) Remove(req *fuse.RemoveRequest, intr fs.Intr) fuse.Error {
+	op := startOp("remove", p)
+	defer op.end()
+	if ReadOnly {
+		return fuse.Errno(syscall.EROFS)
+	}
 	lock.LOCK.Lock()
 	defer lock.LOCK.Unlock()
 	p.checkForUpdates()
-	AssertExpanded(p)
+	if err := AssertExpanded(op.context(), p); err != nil {
+		return fuseError(err)
+	}
+
+	if p == snapshotsDir {
+		/* rmdir /.snapshots/<name> deletes the snapshot */
+		if err := DeleteSnapshot(req.Name); err != nil {
+			return fuse.ENOENT
+		}
+		delete(p.children, req.Name)
+		return nil
+	}
 
 	if !isAllowed(p, "w") {
 		return fuse.Errno(syscall.EACCES)
 	}
 
-
-	//util.P_out("remove: %s", p.Name)
 	child, ok := p.children[req.Name] /* child is to be deleted */
 
 	/* update the structure and remove the subtree rooted here */
-	if child.archive {
-		util.P_out("special case of rmdir: removing archive")
+	if ok && child.archive {
+		fuseLog.Debug("removing archive", "node", p.Name, "name", req.Name)
 		delete(p.children, req.Name)
 		child = nil
 		return nil
 	}
 
 	if !ok {
-		util.P_out("invalid file or directory!")
+		fuseLog.Debug("nothing to remove", "node", p.Name, "name", req.Name)
 		return fuse.ENOENT
 	} else {
 		performDelete := (req.Dir && child.Attrib.Mode.IsDir() && len(child.Kids) == 0) || (!req.Dir && !child.Attrib.Mode.IsDir())
 
 		if performDelete {
-			util.P_out("remove successful")
+			fuseLog.Debug("removed", "node", p.Name, "name", req.Name)
 			delete(p.children, req.Name)
 			delete(p.Kids, req.Name)
 			updateAncestors(p)
 		} else {
-			util.P_out("kids len = %d", len(child.Kids))
+			fuseLog.Debug("not removing", "node", p.Name, "name", req.Name, "kids", len(child.Kids))
 			return fuse.Errno(syscall.EPERM)
 		}
 	}
@@ -380,10 +533,17 @@ func (p *MyNode) Remove(req *fuse.RemoveRequest, intr fs.Intr) fuse.Error {
 
 /* write to a file */
 func (n *MyNode) Write(req *fuse.WriteRequest, resp *fuse.WriteResponse, intr fs.Intr) fuse.Error {
+	op := startOp("write", n)
+	defer op.end()
+	if ReadOnly {
+		return fuse.Errno(syscall.EROFS)
+	}
 	lock.LOCK.Lock()
 	defer lock.LOCK.Unlock()
 	n.checkForUpdates()
-	AssertExpanded(n)
+	if err := AssertExpanded(op.context(), n); err != nil {
+		return fuseError(err)
+	}
 	if !isAllowed(n, "w") {
 		return fuse.Errno(syscall.EACCES)
 	}
@@ -429,24 +589,28 @@ func (n *MyNode) Write(req *fuse.WriteRequest, resp *fuse.WriteResponse, intr fs
 
 	/* TODO update ancestors' versions */
 	updateAncestors(n)
+	touchNode(n)
 
 	return nil
 }
 
 /* read from a file */
 func (n *MyNode) ReadAll(intr fs.Intr) ([]byte, fuse.Error) {
+	op := startOp("read", n)
+	defer op.end()
 	lock.LOCK.Lock()
 	defer lock.LOCK.Unlock()
 	if !isAllowed(n, "r") {
-		util.P_out("CANT read stuff from %s (%p)", n.Name, n)
+		fuseLog.Debug("read not allowed", "node", n.Name)
 		return nil, fuse.Errno(syscall.EACCES)
 	}
 
 	n.checkForUpdates()
-	AssertExpanded(n)
-	util.P_out("readall on %v (%p)", n, n)
-	util.P_out("reading stuff size=%d, from %s", n.Attrib.Size, n.Name)
-	util.P_out("datablocks: %v", n.DataBlocks)
+	if err := AssertExpanded(op.context(), n); err != nil {
+		return nil, fuseError(err)
+	}
+	defer evictNodes()
+	fuseLog.Debug("read", "node", n.Name, "vid", n.Vid, "size", n.Attrib.Size, "chunks", len(n.DataBlocks))
 	return n.data[:n.Attrib.Size], nil
 }
 
@@ -456,70 +620,106 @@ func (n *MyNode) ReadAll(intr fs.Intr) ([]byte, fuse.Error) {
 	(There is no guarantee that it will be called after file writes)
 */
 func (n *MyNode) Flush(req *fuse.FlushRequest, intr fs.Intr) fuse.Error {
+	op := startOp("flush", n)
+	defer op.end()
 	lock.LOCK.Lock()
 	defer lock.LOCK.Unlock()
+	/* publish what was written through this descriptor soon, without waiting on the disk */
+	if n.dirty {
+		requestFlush()
+	}
 	return nil
 }
 
 /* rename a file (p = parent node) */
 func (p *MyNode) Rename(req *fuse.RenameRequest, newDir fs.Node, intr fs.Intr) fuse.Error {
+	op := startOp("rename", p)
+	defer op.end()
+	if ReadOnly {
+		return fuse.Errno(syscall.EROFS)
+	}
 	lock.LOCK.Lock()
 	defer lock.LOCK.Unlock()
 	p.checkForUpdates()
-	AssertExpanded(p)
+	if err := AssertExpanded(op.context(), p); err != nil {
+		return fuseError(err)
+	}
 
 	if !isAllowed(p, "w") {
 		return fuse.Errno(syscall.EACCES)
 	}
 
+	/* passed newDir better be a *MyNode, and loaded before anything is detached */
+	newParent, ok := newDir.(*MyNode)
+	if !ok {
+		return fuse.EIO
+	}
+	if err := AssertExpanded(op.context(), newParent); err != nil {
+		return fuseError(err)
+	}
+
 	/* remove child from current parent */
-	childToRename := p.children[req.OldName]
+	childToRename, found := p.children[req.OldName]
+	if !found {
+		return fuse.ENOENT
+	}
 
 	if childToRename.archive {
 		return fuse.Errno(syscall.EPERM)
 	}
 
+	oldPath := nodePath(childToRename)
 	delete(p.children, req.OldName)
 	delete(p.Kids, req.OldName)
 	updateAncestors(p)
 
-	/* attach to new parent, passed newDir better be a *MyNode */
-	newParent, ok := newDir.(*MyNode)
-	AssertExpanded(newParent)
-	if !ok {
-		return fuse.EIO
-	}
+	/* attach to new parent */
 	newParent.children[req.NewName] = childToRename
 	childToRename.Name = req.NewName
 	childToRename.parent = newParent
 	updateAncestors(childToRename)
+	movePins(oldPath, nodePath(childToRename))
 
 	return nil
 }
 
 /* get file attributes */
 func (n *MyNode) Getattr(req *fuse.GetattrRequest, resp *fuse.GetattrResponse, intr fs.Intr) fuse.Error {
+	op := startOp("getattr", n)
+	defer op.end()
+	lock.LOCK.Lock()
+	defer lock.LOCK.Unlock()
 	n.checkForUpdates()
-	AssertExpanded(n)
-	//util.P_out("getting attr for %s", n.Name)
+	/* the attributes are in the version record, the contents are loaded again when read */
+	if err := AssertExpanded(op.context(), n); err != nil {
+		fuseLog.Debug("getattr without contents", "node", n.Name, "err", err)
+	}
 	resp.Attr = n.Attrib
+	resp.Attr.Inode = n.inode()
 	return nil
 }
 
 /* implementing this otherwise can't set permissions */
 func (n *MyNode) Setattr(req *fuse.SetattrRequest, resp *fuse.SetattrResponse, intr fs.Intr) fuse.Error {
+	op := startOp("setattr", n)
+	defer op.end()
+	if ReadOnly {
+		return fuse.Errno(syscall.EROFS)
+	}
 	lock.LOCK.Lock()
 	defer lock.LOCK.Unlock()
 	n.checkForUpdates()
-	AssertExpanded(n)
+	if err := AssertExpanded(op.context(), n); err != nil {
+		return fuseError(err)
+	}
 
 	if !isAllowed(n, "w") {
-		util.P_out(">>>>>>>>>>>>>>>>>>>>>>>>>>>> set attr is not allowed for %s", n.Name)
+		fuseLog.Debug("setattr not allowed", "node", n.Name)
 		return fuse.Errno(syscall.EACCES)
 	}
 
 	if req.Valid.Mode() {
-		util.P_out("================================ %s => setting mode perm: %v", n.Name, req.Mode.Perm())
+		fuseLog.Debug("setattr", "node", n.Name, "mode", req.Mode)
 		n.Attrib.Mode = req.Mode
 	}
 	if req.Valid.Atime() {
@@ -541,3 +741,137 @@ func (n *MyNode) Setattr(req *fuse.SetattrRequest, resp *fuse.SetattrResponse, i
 
 	return nil
 }
+
+/* control attributes: PIN_XATTR pins a subtree (see pin.go), REPLICAS_XATTR sets its replication factor (see replication.go), RESTORE_XATTR restores an old version (see restore.go) */
+func (n *MyNode) Getxattr(req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse, intr fs.Intr) fuse.Error {
+	op := startOp("getxattr", n)
+	defer op.end()
+	lock.LOCK.Lock()
+	path := nodePath(n)
+	lock.LOCK.Unlock()
+
+	if req.Name == PIN_XATTR {
+		p, found := pinOf(path)
+		if !found {
+			return fuse.Errno(syscall.ENODATA)
+		}
+		status := p.String()
+		if p.Path != path {
+			status = "pinned by " + status
+		}
+		resp.Xattr = []byte(status)
+		return nil
+	} else if req.Name == REPLICAS_XATTR {
+		lock.LOCK.Lock()
+		factor := n.replicationFactor()
+		lock.LOCK.Unlock()
+		resp.Xattr = []byte(fmt.Sprintf("%d", factor))
+		return nil
+	}
+	return fuse.Errno(syscall.ENODATA)
+}
+
+func (n *MyNode) Listxattr(req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse, intr fs.Intr) fuse.Error {
+	op := startOp("listxattr", n)
+	defer op.end()
+	lock.LOCK.Lock()
+	path := nodePath(n)
+	lock.LOCK.Unlock()
+
+	if _, found := pinOf(path); found {
+		resp.Append(PIN_XATTR)
+	}
+	resp.Append(REPLICAS_XATTR)
+	return nil
+}
+
+func (n *MyNode) Setxattr(req *fuse.SetxattrRequest, intr fs.Intr) fuse.Error {
+	op := startOp("setxattr", n)
+	defer op.end()
+	lock.LOCK.Lock()
+	path := nodePath(n)
+	archive := n.archive
+	lock.LOCK.Unlock()
+
+	if req.Name != PIN_XATTR && req.Name != REPLICAS_XATTR && req.Name != RESTORE_XATTR {
+		return fuse.Errno(syscall.ENOTSUP)
+	}
+	/* pins only decide what is kept here, a read-only replica may have them too */
+	if ReadOnly && req.Name != PIN_XATTR {
+		return fuse.Errno(syscall.EROFS)
+	}
+	if archive {
+		return fuse.Errno(syscall.EACCES)
+	}
+
+	var err error
+	if req.Name == RESTORE_XATTR {
+		vid, dest := parseRestoreRequest(string(req.Xattr))
+		if vid == "" {
+			return fuse.Errno(syscall.EINVAL)
+		}
+		lock.LOCK.Lock()
+		root := n
+		for root.parent != nil {
+			root = root.parent
+		}
+		err = restoreVersion(root, path, vid, dest)
+		lock.LOCK.Unlock()
+		if err != nil {
+			fuseLog.Warn("restore failed", "path", path, "err", err)
+			return fuse.Errno(syscall.EINVAL)
+		}
+		return nil
+	} else if req.Name == PIN_XATTR {
+		err = PinPath(path)
+	} else {
+		factor, perr := strconv.Atoi(strings.TrimSpace(string(req.Xattr)))
+		if perr != nil || factor < 1 {
+			return fuse.Errno(syscall.EINVAL)
+		}
+		lock.LOCK.Lock()
+		err = SetReplicationFactor(n, factor)
+		lock.LOCK.Unlock()
+	}
+	if err != nil {
+		fuseLog.Warn("setxattr failed", "path", path, "xattr", req.Name, "err", err)
+		return fuse.EIO
+	}
+	return nil
+}
+
+func (n *MyNode) Removexattr(req *fuse.RemovexattrRequest, intr fs.Intr) fuse.Error {
+	op := startOp("removexattr", n)
+	defer op.end()
+	if ReadOnly && req.Name != PIN_XATTR {
+		return fuse.Errno(syscall.EROFS)
+	}
+	lock.LOCK.Lock()
+	path := nodePath(n)
+	lock.LOCK.Unlock()
+
+	var err error
+	if req.Name == PIN_XATTR {
+		if _, found := GetPin(path); !found {
+			return fuse.Errno(syscall.ENODATA)
+		}
+		err = UnpinPath(path)
+	} else if req.Name == REPLICAS_XATTR {
+		lock.LOCK.Lock()
+		defer lock.LOCK.Unlock()
+		if n.archive {
+			return fuse.Errno(syscall.EACCES)
+		}
+		if n.Replicas == 0 {
+			return fuse.Errno(syscall.ENODATA)
+		}
+		err = SetReplicationFactor(n, 0)
+	} else {
+		return fuse.Errno(syscall.ENODATA)
+	}
+	if err != nil {
+		fuseLog.Warn("removexattr failed", "path", path, "xattr", req.Name, "err", err)
+		return fuse.EIO
+	}
+	return nil
+}
@@ -1,12 +1,14 @@
 package fsys
 
 import (
-	"github.com/pebbe/zmq4"
 	"fmt"
+	"time"
+	"sync"
 	"encoding/json"
 	"p4/util"
-	"p4/lock"
 	"p4/storage"
+	"p4/transport"
+	"p4/trace"
 )
 
 const (
@@ -15,13 +17,37 @@ const (
 	DATA_REPLY
 	METADATA_REQUEST
 	METADATA_REPLY
+	UPDATE_REQUEST
+	UPDATE_REPLY
+	UPDATE_ACK
+	UPDATE_ACK_REPLY
+	UPDATE_HEAD
+	JOIN_REQUEST
+	JOIN_REPLY
+	MEMBERSHIP_GOSSIP
+	HEARTBEAT
+	CHUNK_PUSH
+	CHUNK_PUSH_REPLY
+	UPDATE_DATA
 	INVALID
 )
 
+/*
+	Replicas only listen to replicas speaking the same protocol version, which changes whenever
+	they would misread each other's messages. Builds from before it was sent speak version 0.
+	1: version ids are hashes of the versions rather than paths
+	2: node ids carry the pid of their creator, legacy ones too
+*/
+const PROTOCOL_VERSION int = 2
+
+/* how long to wait on a peer before giving up on a request */
+const REQUEST_TIMEOUT = 5 * time.Second
+
 
 type Message struct {
 	Type int
 	From int
+	Protocol int
 
 	Versions map[string]MyNode
 
@@ -30,6 +56,27 @@ type Message struct {
 
 	RequestedMetadata string
 	ReturnedMetadata MyNode
+
+	/* update log: position of an update, the first position wanted by an UPDATE_REQUEST, or the head of the log in its reply */
+	LogEpoch string
+	Seq uint64
+	Entries []LogEntry
+
+	/* membership: a joining replica, or the sender's view of the member list */
+	Members []Member
+
+	/* heartbeat: when it was sent, and the last heartbeat heard from each peer */
+	SentAt time.Time
+	Echoes map[int]HeartbeatEcho
+
+	/* replication: a chunk pushed to a replica, how many replicas it wants and who holds it. UPDATE_DATA only uses the chunk */
+	PushedHash string
+	PushedData []byte
+	Replicas int
+	Holders []int
+
+	/* the span the message was sent from, so the receiver's spans join its trace */
+	Trace trace.SpanContext
 }
 
 func (m Message) String() string {
@@ -47,10 +94,31 @@ var MountPoint string
 var DbPath string
 var HostAddress util.Endpoint
 
-var PubSocket *zmq4.Socket
-var SubSocket *zmq4.Socket
-var RepSocket *zmq4.Socket
-var ReqSocket *zmq4.Socket
+var Net transport.Transport
+var TransportName string
+var PubSocket transport.Publisher
+var SubSocket transport.Subscriber
+var RepSocket transport.Responder
+
+/* PUB is shared by the flusher and the gossiper */
+var pubLock sync.Mutex
+
+/* peers found speaking another protocol, so each is only logged once. protected by protocolLock */
+var protocolWarned map[int]bool = make(map[int]bool)
+var protocolLock sync.Mutex
+
+func speaksProtocol(msg Message) bool {
+	if msg.Protocol == PROTOCOL_VERSION {
+		return true
+	}
+	protocolLock.Lock()
+	defer protocolLock.Unlock()
+	if !protocolWarned[msg.From] {
+		protocolWarned[msg.From] = true
+		netLog.Warn("ignoring peer speaking another protocol, it needs the same build", "peer", msg.From, "protocol", msg.Protocol, "ours", PROTOCOL_VERSION)
+	}
+	return false
+}
 
 
 func SetMyPid(pid int) {
@@ -73,16 +141,36 @@ func Init(sname string, pid int, mountpoint string, dbpath string, hostaddr util
 	HostAddress = hostaddr
 }
 
+/* picks the transport (see transport.Names) and hands it this replica's keys, if any */
+func InitTransport(name string) error {
+	var err error
+	sec := transport.Security{}
+	if authEnabled() {
+		sec = transport.Security{PublicKey: curvePublic, SecretKey: curveSecret, ServerKey: serverKeyOf}
+	}
+	Net, err = transport.New(name, sec)
+	if err == transport.ErrNoAuth {
+		return fmt.Errorf("the %s transport can't authenticate: a key file needs the zmq transport", name)
+	} else if err != nil {
+		return err
+	}
+	TransportName = name
+	for _, m := range GetAllMembers() {
+		allowMember(m)
+	}
+	netLog.Info("using transport", "transport", name)
+	return nil
+}
+
 /* start publish socket */
 func StartPub() error {
 	var err error
-	PubSocket, err = zmq4.NewSocket(zmq4.PUB)
+	PubSocket, err = Net.Publish(HostAddress.String())
 	if err == nil {
-		PubSocket.Bind(HostAddress.Tcpformat())
-		util.P_out("PUB started on %s", HostAddress.Tcpformat())
+		netLog.Info("PUB started", "addr", HostAddress.String())
 		return nil
 	} else {
-		util.P_out("err: %v", err)
+		netLog.Error("PUB failed", "err", err)
 		return err
 	}
 }
@@ -91,84 +179,139 @@ func StartPub() error {
 func StartRep() error {
 	go func() error {
 		var err error
-		RepSocket, err = zmq4.NewSocket(zmq4.REP)
+		RepSocket, err = Net.Respond(HostAddress.RepEndpoint().String())
 		if err == nil {
-			RepSocket.Bind(HostAddress.RepTcpFormat())
-			util.P_out("REP started on %s", HostAddress.RepTcpFormat())
+			netLog.Info("REP started", "addr", HostAddress.RepEndpoint().String())
 
 			for true {
-				req, _ := RepSocket.Recv(0)
+				req, identity, rerr := RepSocket.Recv()
+				if rerr != nil {
+					netLog.Info("REP stopped", "err", rerr)
+					return rerr
+				}
 
 				var msg Message
-				json.Unmarshal([]byte(req), &msg)
+				merr := json.Unmarshal([]byte(req), &msg)
+				if merr != nil {
+					netLog.Warn("malformed request", "err", merr)
+				}
 
-				util.P_out("RECEIVED DATA REQUEST! %v", msg.RequestedHash)
+				peer := writerName(msg.From)
+				netLog.Debug("request", "type", msg.Type, "peer", peer)
+				span := trace.Start(msg.Trace, "REP", "type", fmt.Sprintf("%d", msg.Type), "peer", peer)
+
+				/* anyone can claim to be msg.From, so only an authorized request is a sign of its life */
+				authorized := merr == nil && speaksProtocol(msg) && authorizeRequest(msg, identity)
+				if authorized {
+					markSeen(msg.From)
+					countReceived(peer, len(req))
+				}
 
 				var tosend Message
 
-				if msg.Type == DATA_REQUEST {
+				tosend.Protocol = PROTOCOL_VERSION
+				if !authorized {
+					tosend.Type = INVALID
+				} else if msg.Type == DATA_REQUEST {
 					tosend.Type = DATA_REPLY
-					ret, e := storage.Get([]byte(fmt.Sprintf("%s:%v", DATA_KEY, msg.RequestedHash))) /* ignore error for now */
-					util.P_out("error: %v", e)
+					ret, e := storage.Get([]byte(fmt.Sprintf("%s:%v", DATA_KEY, msg.RequestedHash)))
+					if e != nil {
+						/* an empty reply tells the requester to ask someone else */
+						netLog.Debug("don't have chunk", "chunk", msg.RequestedHash, "peer", peer)
+					}
 					tosend.ReturnedData = ret
 				} else if msg.Type == METADATA_REQUEST {
 					tosend.Type = METADATA_REPLY
-					ret, _ := storage.Get([]byte(fmt.Sprintf("%s:%v", NODE_VERSION_KEY, msg.RequestedMetadata)))
+					ret, e := storage.Get([]byte(fmt.Sprintf("%s:%v", NODE_VERSION_KEY, msg.RequestedMetadata)))
 					tosend.ReturnedMetadata = MyNode{}
-					json.Unmarshal(ret, &tosend.ReturnedMetadata)
+					if e == nil {
+						e = json.Unmarshal(ret, &tosend.ReturnedMetadata)
+					}
+					if e != nil {
+						netLog.Debug("don't have version", "vid", msg.RequestedMetadata, "peer", peer, "err", e)
+					}
+				} else if msg.Type == UPDATE_REQUEST {
+					tosend.Type = UPDATE_REPLY
+					head := GetLogHead()
+					tosend.LogEpoch = head.Epoch
+					tosend.Seq = head.Seq
+					tosend.Entries = ReadUpdates(msg.Seq)
+				} else if msg.Type == UPDATE_ACK {
+					tosend.Type = UPDATE_ACK_REPLY
+					RecordAck(msg.From, LogPosition{msg.LogEpoch, msg.Seq})
+				} else if msg.Type == JOIN_REQUEST {
+					tosend.Type = JOIN_REPLY
+					MergeMembers(msg.Members)
+					tosend.Members = GetAllMembers()
+				} else if msg.Type == CHUNK_PUSH {
+					tosend.Type = INVALID
+					if receiveChunk(msg) {
+						tosend.Type = CHUNK_PUSH_REPLY
+					}
 				} else {
 					tosend.Type = INVALID
 				}
 				str, _ := json.Marshal(tosend)
-				RepSocket.Send(string(str[:]), 0)
+				countSent(peer, len(str))
+				RepSocket.Reply(str)
+				span.End()
 			}
 
 			return nil
 		} else {
+			netLog.Error("REP failed", "err", err)
 			return err
 		}
 	}()
 	return nil
 }
 
-func StartReq() error {
-	var err error
-	ReqSocket, err = zmq4.NewSocket(zmq4.REQ)
-	util.P_out("REQ started on %s", HostAddress.RepTcpFormat())
-	return err
-}
-
-/* start subscribe socket */
-func StartSub(endpointList []util.Endpoint, fs *MyFS) error {
+/* start subscribe socket. connects to every member and follows membership changes */
+func StartSub(fs *MyFS) error {
 	go func() error {
 		var err error
-		SubSocket, err = zmq4.NewSocket(zmq4.SUB)
-		SubSocket.SetSubscribe("")
+		SubSocket, err = Net.NewSubscriber()
 		if err == nil {
-			for i := 0; i < len(endpointList); i++ {
-				/* don't subscribe to self */
-				if HostAddress != endpointList[i] {
-					util.P_out("connecting to: %s", endpointList[i].Tcpformat())
-					SubSocket.Connect(endpointList[i].Tcpformat())
-				}
+			for _, topic := range subscriptionTopics() {
+				SubSocket.Subscribe(topic)
 			}
-			util.P_out("SUB started")
+			netLog.Info("SUB started")
 			for true {
-				s, _ := SubSocket.Recv(0)
+				syncSubscriptions(fs)
+				/* wake up regularly to follow membership changes even when nothing is published */
+				frame, addr, rerr := SubSocket.Recv(time.Second)
+				if rerr == transport.ErrTimeout {
+					continue
+				} else if rerr != nil {
+					netLog.Info("SUB stopped", "err", rerr)
+					return rerr
+				}
+				topic, s := splitFrame(frame)
 				var msg Message
-				json.Unmarshal([]byte(s), &msg)
-				util.P_out("received!: %v", msg)
-
-				if msg.Type == UPDATE_BROADCAST {
-					/* race for lock */
-					lock.LOCK.Lock()
-					Merge(msg.Versions, fs)
-					lock.LOCK.Unlock()
+				if err := json.Unmarshal(s, &msg); err != nil {
+					netLog.Warn("malformed broadcast", "err", err)
+					continue
+				}
+				if !speaksProtocol(msg) || !authorizeBroadcast(msg, addr) {
+					continue
+				}
+				netLog.Debug("received", "type", msg.Type, "peer", msg.From)
+				markSeen(msg.From)
+				countReceived(writerName(msg.From), len(frame))
+
+				if msg.Type == UPDATE_BROADCAST || msg.Type == UPDATE_HEAD {
+					receiveUpdate(msg, fs)
+				} else if msg.Type == MEMBERSHIP_GOSSIP {
+					MergeMembers(msg.Members)
+				} else if msg.Type == HEARTBEAT {
+					receiveHeartbeat(msg)
+				} else if msg.Type == UPDATE_DATA {
+					receiveUpdateData(msg, topic)
 				}
 			}
 			return nil
 		} else {
-			util.P_out("err: %v", err)
+			netLog.Error("SUB failed", "err", err)
 			return err
 		}
 	}()
@@ -176,71 +319,161 @@ func StartSub(endpointList []util.Endpoint, fs *MyFS) error {
 }
 
 
-func SendUpdateMessage(versions map[string]MyNode) {
+/* publishes a message to every subscriber */
+func publish(m Message) {
+	publishTopic("", m)
+}
+
+/* publishes a message to the subscribers of a topic (see subscription.go) */
+func publishTopic(topic string, m Message) {
+	m.Protocol = PROTOCOL_VERSION
+	str, _ := json.Marshal(m)
+	frame := topicFrame(topic, str)
+	countSent(BROADCAST_PEER, len(frame))
+	pubLock.Lock()
+	defer pubLock.Unlock()
+	PubSocket.Send(frame)
+}
+
+/* publishes an update: first the new data, to the subscribers of each file (see subscription.go), then the versions, to everyone */
+func SendUpdateMessage(parent trace.SpanContext, entry LogEntry) {
+	sendUpdateData(entry)
+
 	m := Message{}
 	m.Type = UPDATE_BROADCAST
 	m.From = Pid
-	m.Versions = versions
-	/* publish */
-	str, _ := json.Marshal(m)
-	PubSocket.Send(string(str[:]), zmq4.DONTWAIT)
+	m.LogEpoch = GetLogHead().Epoch
+	m.Seq = entry.Seq
+	m.Versions = entry.Versions
+	m.Trace = parent
+	publish(m)
 }
 
+/* announces the head of the local log so peers that missed something come and ask for it */
+func SendLogHead() {
+	head := GetLogHead()
+	m := Message{}
+	m.Type = UPDATE_HEAD
+	m.From = Pid
+	m.LogEpoch = head.Epoch
+	m.Seq = head.Seq
+	publish(m)
+}
 
-func PerformDataRequest(hash string, destination string) []byte {
+/* gossips the local member list */
+func SendGossip() {
 	m := Message{}
-	m.Type = DATA_REQUEST
+	m.Type = MEMBERSHIP_GOSSIP
 	m.From = Pid
-	m.RequestedHash = hash
+	m.Members = GetAllMembers()
+	publish(m)
+}
 
+/* sends a request to the REP socket of the replica at dest and waits at most REQUEST_TIMEOUT for the reply */
+func sendRequest(m Message, dest util.Endpoint) (Message, error) {
+	var reply Message
+	m.Protocol = PROTOCOL_VERSION
 	str, _ := json.Marshal(m)
-	util.P_out("requesting data!: %s", string(str[:]))
-
-	ReqSocket.Connect(destination)
-	ReqSocket.Send(string(str[:]), 0)
+	peer := peerName(dest)
+	countSent(peer, len(str))
+	s, err := Net.Request(dest.RepEndpoint().String(), str, REQUEST_TIMEOUT)
+	if err != nil {
+		return reply, err
+	}
+	countReceived(peer, len(s))
+	err = json.Unmarshal(s, &reply)
+	if err == nil && reply.Protocol != PROTOCOL_VERSION {
+		err = fmt.Errorf("%v speaks protocol %d, we speak %d", dest, reply.Protocol, PROTOCOL_VERSION)
+	}
+	return reply, err
+}
 
 
-	reply, _ := ReqSocket.Recv(0)
-	var msg Message
-	json.Unmarshal([]byte(reply), &msg)
+/* fetches a data chunk, asking its last writer first and then any other live peer */
+func PerformDataRequest(parent trace.SpanContext, hash string, lastWriter int) (data []byte, err error) {
+	span := trace.Start(parent, "PerformDataRequest", "chunk", hash)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+	m := Message{}
+	m.Type = DATA_REQUEST
+	m.From = Pid
+	m.RequestedHash = hash
+	m.Trace = span.Context()
+
+	answered := false
+	for _, pid := range requestCandidates(lastWriter) {
+		netLog.Debug("requesting chunk", "chunk", hash, "peer", pid)
+		start := time.Now()
+		msg, err := sendRequest(m, GetEndpointFromPid(pid))
+		if err != nil {
+			markFailed(pid)
+			continue
+		}
+		markRTT(pid, time.Since(start))
+		answered = true
 
-	if msg.Type == DATA_REPLY {
-		util.P_out("received 1 data slice")
-		return msg.ReturnedData
-	} else {
-		util.P_out("SCREW UP!")
-		return []byte{}
+		if msg.Type == DATA_REPLY && len(msg.ReturnedData) > 0 {
+			span.SetAttr("peer", writerName(pid))
+			return msg.ReturnedData, nil
+		}
 	}
+	netLog.Warn("no peer could supply chunk", "chunk", hash, "answered", answered)
+	if !answered {
+		return []byte{}, fmt.Errorf("chunk %s: %w", hash, ErrPeerUnreachable)
+	}
+	return []byte{}, fmt.Errorf("chunk %s: %w", hash, ErrChunkMissing)
 }
 
 
-func PerformMetaDataRequest(Vid string, destination string) MyNode {
+/* fetches a node version, asking its last writer first and then any other live peer */
+func PerformMetaDataRequest(parent trace.SpanContext, Vid string, lastWriter int) (node MyNode, err error) {
+	span := trace.Start(parent, "PerformMetaDataRequest", "vid", Vid)
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
 	m := Message{}
 	m.Type = METADATA_REQUEST
 	m.From = Pid
 	m.RequestedMetadata = Vid
+	m.Trace = span.Context()
+
+	answered := false
+	for _, pid := range requestCandidates(lastWriter) {
+		netLog.Debug("requesting version", "vid", Vid, "peer", pid)
+		start := time.Now()
+		msg, err := sendRequest(m, GetEndpointFromPid(pid))
+		if err != nil {
+			markFailed(pid)
+			continue
+		}
+		markRTT(pid, time.Since(start))
+		answered = true
 
-	str, _ := json.Marshal(m)
-	util.P_out("requesting metadata!: %s", string(str[:]))
-
-	ReqSocket.Connect(destination)
-	ReqSocket.Send(string(str[:]), 0)
-
-	reply, _ := ReqSocket.Recv(0)
-	var msg Message
-	json.Unmarshal([]byte(reply), &msg)
-
-	if msg.Type == METADATA_REPLY {
-		util.P_out("received 1 metadata!")
-		return msg.ReturnedMetadata
-	} else {
-		util.P_out("SCREW UP!")
-		return MyNode{}
+		if msg.Type == METADATA_REPLY && msg.ReturnedMetadata.Vid == Vid {
+			span.SetAttr("peer", writerName(pid))
+			return msg.ReturnedMetadata, nil
+		}
+	}
+	netLog.Warn("no peer could supply version", "vid", Vid, "answered", answered)
+	if !answered {
+		return MyNode{}, fmt.Errorf("version %s: %w", Vid, ErrPeerUnreachable)
 	}
+	return MyNode{}, fmt.Errorf("version %s: %w", Vid, ErrVersionMissing)
 }
 
 func Close() {
+	if ctlListener != nil {
+		ctlListener.Close()
+	}
+	if metricsListener != nil {
+		metricsListener.Close()
+	}
+	StopTracing()
 	PubSocket.Close()
 	SubSocket.Close()
 	RepSocket.Close()
+	Net.Close()
 }
@@ -0,0 +1,222 @@
+package fsys
+
+import (
+	"fmt"
+	"sync"
+	"time"
+	"testing"
+	"encoding/json"
+	"p4/lock"
+	"p4/util"
+	"p4/transport"
+)
+
+/*
+	Replicas keep their state in package globals, so a test process holds one replica: the one
+	under test, pid 1. Its peers are played by the test through sockets of their own on the
+	same inproc transport, speaking the protocol with hand-made messages.
+*/
+
+/* every replica and peer gets addresses of its own, sockets of an earlier test may still be closing */
+var testPort int = 7000
+
+func nextTestAddress() util.Endpoint {
+	testPort += 10
+	return util.Endpoint{Ipaddr: "test", Port: testPort}
+}
+
+/* who the replica under test is doesn't change between tests, background work of the last one may still look */
+var testReplica sync.Once
+
+/* sets up pid 1 on a new store with its PUB and REP sockets serving */
+func startTestReplica(t *testing.T) *MyFS {
+	testReplica.Do(func() {
+		lock.Init()
+		Init("one", 1, "", "", nextTestAddress())
+		if err := InitTransport("inproc"); err != nil {
+			t.Fatalf("transport: %v", err)
+		}
+	})
+	openTestStore(t)
+	InitMembership()
+	LoadUpdateLog()
+	State = STATE{}
+	fs := &MyFS{}
+	if err := LoadFS(fs); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if err := StartPub(); err != nil {
+		t.Fatalf("pub: %v", err)
+	}
+	t.Cleanup(func() { PubSocket.Close() })
+	StartRep()
+
+	/* REP starts in the background; it serves once a request gets through */
+	ping, _ := json.Marshal(Message{Type: UPDATE_REQUEST, Protocol: PROTOCOL_VERSION, Seq: 1})
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if _, err := Net.Request(HostAddress.RepEndpoint().String(), ping, 50 * time.Millisecond); err == nil {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("REP not serving: %v", err)
+		}
+	}
+	t.Cleanup(func() { RepSocket.Close() })
+	return fs
+}
+
+/* starts the SUB socket of the replica under test. it is up once it asks `peer` to catch up */
+func startTestSub(t *testing.T, fs *MyFS, peer *testPeer) {
+	subscribedTo = nil
+	StartSub(fs)
+	peer.waitFor(t, UPDATE_REQUEST, nil)
+	t.Cleanup(func() { SubSocket.Close() })
+}
+
+/* a peer of the replica under test, answering its requests from what the test gave it */
+type testPeer struct {
+	member Member
+	pub transport.Publisher
+	rep transport.Responder
+	requests chan Message
+
+	lock sync.Mutex
+	epoch string
+	log []LogEntry
+	members []Member	/* answer to a join */
+}
+
+func newTestPeer(t *testing.T, pid int) *testPeer {
+	addr := nextTestAddress()
+	p := &testPeer{
+		member: Member{pid, fmt.Sprintf("peer%d", pid), addr, "", 1, false},
+		requests: make(chan Message, 100),
+		epoch: fmt.Sprintf("%d-test", pid),
+	}
+	var err error
+	if p.pub, err = Net.Publish(addr.String()); err != nil {
+		t.Fatalf("peer %d pub: %v", pid, err)
+	}
+	if p.rep, err = Net.Respond(addr.RepEndpoint().String()); err != nil {
+		t.Fatalf("peer %d rep: %v", pid, err)
+	}
+	t.Cleanup(func() {
+		p.pub.Close()
+		p.rep.Close()
+	})
+	go p.serve()
+	return p
+}
+
+func (p *testPeer) serve() {
+	for {
+		req, _, err := p.rep.Recv()
+		if err != nil {
+			return
+		}
+		var msg Message
+		json.Unmarshal(req, &msg)
+		reply := p.reply(msg)
+		reply.From = p.member.Pid
+		reply.Protocol = PROTOCOL_VERSION
+		str, _ := json.Marshal(reply)
+		p.rep.Reply(str)
+		select {
+			case p.requests <- msg:
+			default:
+		}
+	}
+}
+
+func (p *testPeer) reply(msg Message) Message {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	switch msg.Type {
+		case UPDATE_REQUEST:
+			entries := []LogEntry{}
+			for _, e := range p.log {
+				if e.Seq >= msg.Seq {
+					entries = append(entries, e)
+				}
+			}
+			return Message{Type: UPDATE_REPLY, LogEpoch: p.epoch, Seq: uint64(len(p.log)), Entries: entries}
+		case UPDATE_ACK:
+			return Message{Type: UPDATE_ACK_REPLY}
+		case JOIN_REQUEST:
+			return Message{Type: JOIN_REPLY, Members: p.members}
+		case CHUNK_PUSH:
+			return Message{Type: CHUNK_PUSH_REPLY}
+	}
+	return Message{Type: INVALID}
+}
+
+/* adds an entry to the peer's own update log */
+func (p *testPeer) appendLog(versions map[string]MyNode) LogEntry {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	entry := LogEntry{uint64(len(p.log) + 1), versions}
+	p.log = append(p.log, entry)
+	return entry
+}
+
+func (p *testPeer) publish(m Message) {
+	m.From = p.member.Pid
+	m.Protocol = PROTOCOL_VERSION
+	str, _ := json.Marshal(m)
+	p.pub.Send(topicFrame("", str))
+}
+
+/* sends a request to the replica under test */
+func (p *testPeer) request(t *testing.T, m Message) Message {
+	m.From = p.member.Pid
+	m.Protocol = PROTOCOL_VERSION
+	str, _ := json.Marshal(m)
+	replystr, err := Net.Request(HostAddress.RepEndpoint().String(), str, time.Second)
+	if err != nil {
+		t.Fatalf("peer %d request %d: %v", p.member.Pid, m.Type, err)
+	}
+	var reply Message
+	json.Unmarshal(replystr, &reply)
+	return reply
+}
+
+/* waits for a request of the given type from the replica under test that `match` accepts (nil for any) */
+func (p *testPeer) waitFor(t *testing.T, typ int, match func(Message) bool) Message {
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+			case msg := <-p.requests:
+				if msg.Type == typ && (match == nil || match(msg)) {
+					return msg
+				}
+			case <-deadline:
+				t.Fatalf("peer %d: no request of type %d", p.member.Pid, typ)
+		}
+	}
+}
+
+/* waits for cond to hold, which the replica under test makes true in the background */
+func eventually(t *testing.T, what string, cond func() bool) {
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting until %s", what)
+		}
+	}
+}
+
+func TestRequestsOfAnotherProtocolAreRefused(t *testing.T) {
+	startTestReplica(t)
+	peer := newTestPeer(t, 2)
+	str, _ := json.Marshal(Message{Type: JOIN_REQUEST, From: 2, Protocol: PROTOCOL_VERSION - 1, Members: []Member{peer.member}})
+	replystr, err := Net.Request(HostAddress.RepEndpoint().String(), str, time.Second)
+	if err != nil {
+		t.Fatalf("request: %v", err)
+	}
+	var reply Message
+	json.Unmarshal(replystr, &reply)
+	if reply.Type != INVALID {
+		t.Errorf("reply %d to an old protocol, want INVALID", reply.Type)
+	}
+	if _, found := GetMember(2); found {
+		t.Error("a peer speaking another protocol joined")
+	}
+}
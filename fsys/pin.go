@@ -0,0 +1,293 @@
+package fsys
+
+import (
+	"fmt"
+	"time"
+	"strings"
+	"encoding/json"
+	"p4/storage"
+	"p4/lock"
+	"p4/trace"
+)
+
+/*
+======================
+PINNING
+=======================
+*/
+
+/*
+	A pinned subtree is kept available offline: the pinner periodically walks it, fetches every
+	version and chunk it doesn't have yet and records how far it got. Pins follow their subtree
+	when it is renamed here. Chunks fetched from peers are marked as cached, with the file they
+	were fetched for; CollectGarbage drops cached chunks again unless that file is pinned or
+	subscribed and still uses them. Chunks this replica wrote itself are never collected, peers
+	fetch them from here.
+*/
+
+const PIN_KEY string = "PIN"			/* PIN:<path> => Pin */
+const CACHED_KEY string = "CACHED"		/* CACHED:<hash> => CachedChunk */
+
+/* how often pinned subtrees are synced, and how often unused cached chunks are collected */
+const PIN_SECONDS int = 30
+const GC_SECONDS int = 600
+
+/* extended attribute to pin a file or directory with: set it to pin, remove it to unpin, read it for the progress */
+const PIN_XATTR string = "user.gofs.pin"
+
+/* wakes up the pinner when something new is pinned */
+var pinWakeup chan bool = make(chan bool, 1)
+
+type Pin struct {
+	Path string
+	Created time.Time
+
+	/* progress as of the last sync */
+	LastSync time.Time
+	Chunks int		/* chunks used by files under the pin */
+	Synced int		/* how many of them are stored locally */
+}
+
+type CachedChunk struct {
+	Fetched time.Time
+	Path string		/* the file it was fetched for */
+}
+
+func (p Pin) String() string {
+	if p.LastSync.IsZero() {
+		return fmt.Sprintf("%s: not synced yet", p.Path)
+	}
+	return fmt.Sprintf("%s: %d/%d chunks synced as of %s", p.Path, p.Synced, p.Chunks, p.LastSync.Format(time.RFC3339))
+}
+
+func pinKey(path string) []byte {
+	return []byte(fmt.Sprintf("%s:%s", PIN_KEY, path))
+}
+
+func savePin(p Pin) error {
+	pinstr, _ := json.Marshal(p)
+	return storage.Put(pinKey(p.Path), pinstr)
+}
+
+/* pins the subtree at path. it is synced on the next round of the pinner */
+func PinPath(path string) error {
+	if _, found := GetPin(path); found {
+		return nil
+	}
+	storeLog.Info("pinning", "path", path)
+	err := savePin(Pin{Path: path, Created: time.Now()})
+	if err == nil {
+		select {
+			case pinWakeup <- true:
+			default:
+		}
+	}
+	return err
+}
+
+func UnpinPath(path string) error {
+	storeLog.Info("unpinning", "path", path)
+	return storage.Delete(pinKey(path))
+}
+
+func GetPin(path string) (Pin, bool) {
+	pinstr, err := storage.Get(pinKey(path))
+	if err != nil {
+		return Pin{}, false
+	}
+	var p Pin
+	json.Unmarshal(pinstr, &p)
+	return p, true
+}
+
+func GetPins() []Pin {
+	pins := []Pin{}
+	storage.Iterate([]byte(PIN_KEY + ":"), func(key []byte, val []byte) bool {
+		var p Pin
+		json.Unmarshal(val, &p)
+		pins = append(pins, p)
+		return true
+	})
+	return pins
+}
+
+/* moves the pins at or under `from` along with a rename to `to` */
+func movePins(from string, to string) {
+	for _, p := range GetPins() {
+		if p.Path != from && !strings.HasPrefix(p.Path, from + "/") {
+			continue
+		}
+		old := p.Path
+		p.Path = to + strings.TrimPrefix(old, from)
+		if err := savePin(p); err != nil {
+			storeLog.Error("could not move pin", "from", old, "to", p.Path, "err", err)
+			continue
+		}
+		storage.Delete(pinKey(old))
+		storeLog.Info("moved pin", "from", old, "to", p.Path)
+	}
+}
+
+/* the pin path is under, if any */
+func pinOf(path string) (Pin, bool) {
+	for _, p := range GetPins() {
+		if p.Path == "/" || path == p.Path || strings.HasPrefix(path, p.Path + "/") {
+			return p, true
+		}
+	}
+	return Pin{}, false
+}
+
+func hasDataChunk(hash string) bool {
+	_, err := storage.Get([]byte(fmt.Sprintf("%s:%v", DATA_KEY, hash)))
+	return err == nil
+}
+
+/* remembers that a chunk came from a peer for the file at path, so it may be collected later */
+func markCached(hash string, path string) {
+	cstr, _ := json.Marshal(CachedChunk{time.Now(), path})
+	storage.Put([]byte(fmt.Sprintf("%s:%s", CACHED_KEY, hash)), cstr)
+}
+
+func getCached(hash string) (CachedChunk, bool) {
+	cstr, err := storage.Get([]byte(fmt.Sprintf("%s:%s", CACHED_KEY, hash)))
+	if err != nil {
+		return CachedChunk{}, false
+	}
+	var c CachedChunk
+	json.Unmarshal(cstr, &c)
+	return c, true
+}
+
+type chunkRef struct {
+	hash string
+	lastWriter int
+	path string
+}
+
+/* chunks used by the files under node. caller holds lock.LOCK */
+func chunksUnder(node *MyNode) []chunkRef {
+	refs := []chunkRef{}
+	walkTree(node, func(n *MyNode) {
+		if !n.Attrib.Mode.IsDir() {
+			path := nodePath(n)
+			for _, hash := range n.DataBlocks {
+				refs = append(refs, chunkRef{hash, n.LastWriter, path})
+			}
+		}
+	})
+	return refs
+}
+
+func usesChunk(n *MyNode, hash string) bool {
+	for _, h := range n.DataBlocks {
+		if h == hash {
+			return true
+		}
+	}
+	return false
+}
+
+/* fetches everything under a pin that isn't stored locally yet, and records the progress */
+func SyncPin(fs *MyFS, p Pin) {
+	lock.LOCK.Lock()
+	node := lookupPath(fs, p.Path)
+	refs := []chunkRef{}
+	if node != nil {
+		refs = chunksUnder(node)
+	}
+	lock.LOCK.Unlock()
+
+	if node == nil {
+		storeLog.Debug("pinned path does not exist (yet)", "path", p.Path)
+		return
+	}
+
+	/* network requests happen without holding the lock */
+	synced := 0
+	for _, ref := range refs {
+		if hasDataChunk(ref.hash) {
+			/* cached for another file, e.g. before a rename: keep it for this one */
+			if c, cached := getCached(ref.hash); cached && !isPinnedOrSubscribed(c.Path) {
+				markCached(ref.hash, ref.path)
+			}
+			synced++
+		} else if ref.lastWriter != GetMyPid() {
+			if _, err := loadDataChunk(trace.None, ref.hash, ref.lastWriter, ref.path); err == nil {
+				synced++
+			}
+		}
+	}
+
+	/* it may have been unpinned in the meantime */
+	if _, found := GetPin(p.Path); !found {
+		return
+	}
+	p.LastSync = time.Now()
+	p.Chunks = len(refs)
+	p.Synced = synced
+	savePin(p)
+	storeLog.Debug("pin synced", "path", p.Path, "chunks", p.Chunks, "synced", p.Synced)
+}
+
+/* periodically syncs every pin and collects garbage until quit is closed */
+func StartPinner(quit chan bool, fs *MyFS) {
+	go func() {
+		lastGC := time.Now()
+		for {
+			for _, p := range GetPins() {
+				SyncPin(fs, p)
+			}
+			if time.Since(lastGC) > time.Duration(GC_SECONDS) * time.Second {
+				CollectGarbage(fs)
+				lastGC = time.Now()
+			}
+			select {
+				case <-quit:
+					return
+				case <-pinWakeup:
+				case <-time.After(time.Duration(PIN_SECONDS) * time.Second):
+			}
+		}
+	}()
+}
+
+/*
+	Drops the cached chunks whose file is no longer pinned or subscribed, or no longer uses them.
+	Only the files the chunks were fetched for are looked up. Returns how many were dropped.
+*/
+func CollectGarbage(fs *MyFS) int {
+	cached := make(map[string]CachedChunk)
+	storage.Iterate([]byte(CACHED_KEY + ":"), func(key []byte, val []byte) bool {
+		var c CachedChunk
+		json.Unmarshal(val, &c)
+		cached[strings.TrimPrefix(string(key), CACHED_KEY + ":")] = c
+		return true
+	})
+
+	lock.LOCK.Lock()
+	files := make(map[string]*MyNode)
+	drop := []string{}
+	for hash, c := range cached {
+		if !isPinnedOrSubscribed(c.Path) {
+			drop = append(drop, hash)
+			continue
+		}
+		n, looked := files[c.Path]
+		if !looked {
+			n = lookupPath(fs, c.Path)
+			files[c.Path] = n
+		}
+		if n == nil || n.Attrib.Mode.IsDir() || !usesChunk(n, hash) {
+			drop = append(drop, hash)
+		}
+	}
+	lock.LOCK.Unlock()
+
+	for _, hash := range drop {
+		storage.Delete([]byte(fmt.Sprintf("%s:%v", DATA_KEY, hash)))
+		storage.Delete([]byte(fmt.Sprintf("%s:%s", CACHED_KEY, hash)))
+	}
+	storeLog.Info("garbage collection", "cached", len(cached), "dropped", len(drop))
+	return len(drop)
+}
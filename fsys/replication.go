@@ -0,0 +1,279 @@
+package fsys
+
+import (
+	"fmt"
+	"sort"
+	"time"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/binary"
+	pathpkg "path"
+	"p4/storage"
+)
+
+/*
+======================
+REPLICATION
+=======================
+*/
+
+/*
+	Every chunk should live on a number of replicas (its replication factor) so it survives the
+	loss of its writer's disk. The factor comes from the closest ancestor with REPLICAS_XATTR
+	set, or from DefaultReplicas. It is kept in the node (MyNode.Replicas), so setting it makes
+	a new version that every replica gets like any other change. The writer records each new chunk under REPLICAS_KEY and the
+	replicator pushes it to the members chosen by rendezvous hashing: every member scores
+	sha1(hash, pid) and the highest scores win, so everybody agrees on the placement without
+	talking and a member joining or leaving only moves the chunks it wins or held. A replica that
+	receives a push records the chunk too, so any holder can repair it when a holder goes away.
+*/
+
+const REPLICAS_KEY string = "REPLICAS"			/* REPLICAS:<hash> => ChunkReplicas */
+
+/* how often under-replicated chunks are looked for */
+const REPLICATE_SECONDS int = 10
+
+/* extended attribute holding the replication factor of a subtree */
+const REPLICAS_XATTR string = "user.gofs.replicas"
+
+/* replication factor where no subtree sets one. 1 keeps chunks on their writer only */
+var DefaultReplicas int = 1
+
+type ChunkReplicas struct {
+	Hash string
+	Want int
+	Holders []int
+}
+
+/* wakes up the replicator when there are new chunks */
+var replicateWakeup chan bool = make(chan bool, 1)
+
+func chunkReplicasKey(hash string) []byte {
+	return []byte(fmt.Sprintf("%s:%s", REPLICAS_KEY, hash))
+}
+
+func getChunkReplicas(hash string) (ChunkReplicas, bool) {
+	rstr, err := storage.Get(chunkReplicasKey(hash))
+	if err != nil {
+		return ChunkReplicas{}, false
+	}
+	var r ChunkReplicas
+	json.Unmarshal(rstr, &r)
+	return r, true
+}
+
+func saveChunkReplicas(r ChunkReplicas) {
+	rstr, _ := json.Marshal(r)
+	storage.Put(chunkReplicasKey(r.Hash), rstr)
+}
+
+func (r *ChunkReplicas) addHolder(pid int) {
+	for _, h := range r.Holders {
+		if h == pid {
+			return
+		}
+	}
+	r.Holders = append(r.Holders, pid)
+}
+
+/* holders that are still members */
+func (r ChunkReplicas) liveHolders() []int {
+	live := []int{}
+	for _, h := range r.Holders {
+		if m, found := GetMember(h); found && !m.Left {
+			live = append(live, h)
+		}
+	}
+	return live
+}
+
+/* sets the replication factor of the subtree at n. 0 removes it, so it inherits again. caller holds lock.LOCK */
+func SetReplicationFactor(n *MyNode, factor int) error {
+	if ReadOnly {
+		return ErrReadOnly
+	}
+	if factor < 0 {
+		factor = 0
+	}
+	n.checkForUpdates()
+	n.Replicas = factor
+	updateAncestors(n)
+	storeLog.Info("replication factor", "path", nodePath(n), "replicas", factor)
+	return nil
+}
+
+/* replication factor of the closest ancestor of n that sets one. caller holds lock.LOCK */
+func (n *MyNode) replicationFactor() int {
+	for current := n; current != nil; current = current.parent {
+		if current.Replicas > 0 {
+			return current.Replicas
+		}
+	}
+	return DefaultReplicas
+}
+
+/* the same for path in an update, which holds every ancestor of what changed */
+func replicationFactorIn(versions map[string]MyNode, path string) int {
+	for p := path; ; p = pathpkg.Dir(p) {
+		if v, found := versions[p]; found && v.Replicas > 0 {
+			return v.Replicas
+		}
+		if p == "/" {
+			return DefaultReplicas
+		}
+	}
+}
+
+/* members ordered by their rendezvous score for a chunk, best first */
+func placement(hash string) []int {
+	type scored struct {
+		pid int
+		score uint64
+	}
+	list := []scored{}
+	for _, m := range GetAllMembers() {
+		if m.Left {
+			continue
+		}
+		sum := sha1.Sum([]byte(fmt.Sprintf("%s:%d", hash, m.Pid)))
+		list = append(list, scored{m.Pid, binary.BigEndian.Uint64(sum[:8])})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].score > list[j].score })
+	pids := []int{}
+	for _, s := range list {
+		pids = append(pids, s.pid)
+	}
+	return pids
+}
+
+/* records the chunks this replica wrote in an update, so the replicator pushes them. caller holds lock.LOCK */
+func queueReplication(entry LogEntry) {
+	queued := false
+	for path, v := range entry.Versions {
+		if v.Attrib.Mode.IsDir() || v.LastWriter != GetMyPid() {
+			continue
+		}
+		want := replicationFactorIn(entry.Versions, path)
+		for _, hash := range v.DataBlocks {
+			r, found := getChunkReplicas(hash)
+			if found && r.Want >= want {
+				continue
+			}
+			r.Hash = hash
+			r.Want = want
+			r.addHolder(GetMyPid())
+			saveChunkReplicas(r)
+			queued = queued || want > 1
+		}
+	}
+	if queued {
+		select {
+			case replicateWakeup <- true:
+			default:
+		}
+	}
+}
+
+/* pushes a chunk to placement targets until it has as many live holders as it wants */
+func replicateChunk(r ChunkReplicas) {
+	data, err := storage.Get([]byte(fmt.Sprintf("%s:%v", DATA_KEY, r.Hash)))
+	if err != nil {
+		return
+	}
+	r.Holders = r.liveHolders()
+	r.addHolder(GetMyPid())
+	for _, pid := range placement(r.Hash) {
+		if len(r.Holders) >= r.Want {
+			break
+		}
+		held := false
+		for _, h := range r.Holders {
+			held = held || h == pid
+		}
+		if held || GetPeerStatus(pid) == PEER_DOWN {
+			continue
+		}
+		if pushChunk(pid, r, data) {
+			r.addHolder(pid)
+		}
+	}
+	saveChunkReplicas(r)
+	if len(r.Holders) < r.Want {
+		storeLog.Debug("under-replicated", "chunk", r.Hash, "holders", len(r.Holders), "want", r.Want)
+	}
+}
+
+func pushChunk(pid int, r ChunkReplicas, data []byte) bool {
+	m := Message{}
+	m.Type = CHUNK_PUSH
+	m.From = Pid
+	m.PushedHash = r.Hash
+	m.PushedData = data
+	m.Replicas = r.Want
+	m.Holders = append(append([]int{}, r.Holders...), pid)
+
+	netLog.Debug("pushing chunk", "chunk", r.Hash, "peer", pid)
+	start := time.Now()
+	reply, err := sendRequest(m, GetEndpointFromPid(pid))
+	if err != nil {
+		markFailed(pid)
+		return false
+	}
+	markRTT(pid, time.Since(start))
+	return reply.Type == CHUNK_PUSH_REPLY
+}
+
+/* stores a chunk pushed by a peer. it is kept for good, unlike chunks fetched on demand */
+func receiveChunk(msg Message) bool {
+	sum := sha1.Sum(msg.PushedData)
+	if hex.EncodeToString(sum[:]) != msg.PushedHash {
+		netLog.Warn("dropping pushed chunk, hash does not match", "chunk", msg.PushedHash, "peer", msg.From)
+		return false
+	}
+	storage.Put([]byte(fmt.Sprintf("%s:%v", DATA_KEY, msg.PushedHash)), msg.PushedData)
+	storage.Delete([]byte(fmt.Sprintf("%s:%s", CACHED_KEY, msg.PushedHash)))
+
+	r, _ := getChunkReplicas(msg.PushedHash)
+	r.Hash = msg.PushedHash
+	if msg.Replicas > r.Want {
+		r.Want = msg.Replicas
+	}
+	for _, h := range msg.Holders {
+		r.addHolder(h)
+	}
+	r.addHolder(GetMyPid())
+	saveChunkReplicas(r)
+	return true
+}
+
+/* under-replicated chunks this replica holds */
+func underReplicated() []ChunkReplicas {
+	list := []ChunkReplicas{}
+	storage.Iterate([]byte(REPLICAS_KEY + ":"), func(key []byte, val []byte) bool {
+		var r ChunkReplicas
+		json.Unmarshal(val, &r)
+		if len(r.liveHolders()) < r.Want {
+			list = append(list, r)
+		}
+		return true
+	})
+	return list
+}
+
+/* periodically pushes and repairs under-replicated chunks until quit is closed */
+func StartReplicator(quit chan bool) {
+	go func() {
+		for {
+			for _, r := range underReplicated() {
+				replicateChunk(r)
+			}
+			select {
+				case <-quit:
+					return
+				case <-replicateWakeup:
+				case <-time.After(time.Duration(REPLICATE_SECONDS) * time.Second):
+			}
+		}
+	}()
+}
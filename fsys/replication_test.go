@@ -0,0 +1,89 @@
+package fsys
+
+import (
+	"fmt"
+	"testing"
+	"crypto/sha1"
+	"encoding/hex"
+	"p4/storage"
+)
+
+/* placement ranks every live member, and a member going away leaves the order of the others be */
+func TestPlacementIsRendezvous(t *testing.T) {
+	startTestReplica(t)
+	others := []Member{}
+	for pid := 2; pid <= 5; pid++ {
+		others = append(others, Member{Pid: pid, Name: fmt.Sprintf("peer%d", pid), Incarnation: 1})
+	}
+	MergeMembers(others)
+
+	first := make(map[int]int)
+	before := make(map[string][]int)
+	for i := 0; i < 200; i++ {
+		hash := fmt.Sprintf("chunk%d", i)
+		pids := placement(hash)
+		if len(pids) != 5 {
+			t.Fatalf("placement of %s: %v, want all 5 members", hash, pids)
+		}
+		if again := placement(hash); fmt.Sprint(again) != fmt.Sprint(pids) {
+			t.Fatalf("placement of %s changed from %v to %v", hash, pids, again)
+		}
+		first[pids[0]]++
+		before[hash] = pids
+	}
+	for pid := 1; pid <= 5; pid++ {
+		if first[pid] == 0 {
+			t.Errorf("member %d never placed first in 200 chunks", pid)
+		}
+	}
+
+	gone := others[1]
+	gone.Incarnation++
+	gone.Left = true
+	MergeMembers([]Member{gone})
+	for hash, pids := range before {
+		want := []int{}
+		for _, pid := range pids {
+			if pid != gone.Pid {
+				want = append(want, pid)
+			}
+		}
+		if got := placement(hash); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("placement of %s after %d left: %v, want %v", hash, gone.Pid, got, want)
+		}
+	}
+}
+
+/* a chunk is pushed to the best placed replicas until it has as many as it wants */
+func TestReplicationPushesByPlacement(t *testing.T) {
+	startTestReplica(t)
+	peers := map[int]*testPeer{2: newTestPeer(t, 2), 3: newTestPeer(t, 3)}
+	MergeMembers([]Member{peers[2].member, peers[3].member})
+
+	data := []byte("a chunk of data")
+	sum := sha1.Sum(data)
+	hash := hex.EncodeToString(sum[:])
+	storage.Put([]byte(fmt.Sprintf("%s:%v", DATA_KEY, hash)), data)
+	replicateChunk(ChunkReplicas{Hash: hash, Want: 2})
+
+	target := 0
+	for _, pid := range placement(hash) {
+		if pid != 1 {
+			target = pid
+			break
+		}
+	}
+	push := peers[target].waitFor(t, CHUNK_PUSH, nil)
+	if push.PushedHash != hash || string(push.PushedData) != string(data) || push.Replicas != 2 {
+		t.Errorf("pushed %s (%d replicas), want %s (2 replicas)", push.PushedHash, push.Replicas, hash)
+	}
+	for pid, p := range peers {
+		if pid != target && len(p.requests) > 0 {
+			t.Errorf("peer %d got a push too, only %d should", pid, target)
+		}
+	}
+	r, _ := getChunkReplicas(hash)
+	if len(r.Holders) != 2 || r.Holders[0] != 1 || r.Holders[1] != target {
+		t.Errorf("holders %v, want [1 %d]", r.Holders, target)
+	}
+}
@@ -0,0 +1,171 @@
+package fsys
+
+import (
+	"errors"
+	"strings"
+	"time"
+	pathpkg "path"
+	"p4/lock"
+	"p4/trace"
+)
+
+/*
+======================
+RESTORE
+=======================
+*/
+
+/*
+	Restoring never rewrites history: the chosen version's contents become a new version, which
+	is flushed and published like any other change, so every replica rolls back with it. A
+	version is looked up locally first and then on the peers, so any version listed by
+	GetNodeVersions on any replica can be restored anywhere. Restoring to a new path copies the
+	version (and, for a directory, everything under it) into new nodes next to the original.
+*/
+
+/* extended attribute to restore with: set it to "<vid>" to restore in place, or to "<vid> <path>" to restore to a new path */
+const RESTORE_XATTR string = "user.gofs.restore"
+
+/* restores the node at path to version vid, in place if dest is empty and to the new path dest otherwise */
+func RestoreVersion(fs *MyFS, path string, vid string, dest string) error {
+	lock.LOCK.Lock()
+	defer lock.LOCK.Unlock()
+	r, _ := fs.Root()
+	return restoreVersion(r.(*MyNode), path, vid, dest)
+}
+
+/* caller holds lock.LOCK */
+func restoreVersion(root *MyNode, path string, vid string, dest string) error {
+	if ReadOnly {
+		return ErrReadOnly
+	}
+	n := lookupFrom(root, path)
+	if n == nil {
+		return errors.New(path + " does not exist")
+	}
+
+	/* the last writer isn't known for old versions, any peer may have it */
+	v, err := LoadNodeVersion(trace.None, vid, -1)
+	if err != nil {
+		return err
+	}
+	if v.Vid != vid {
+		return errors.New("no version " + vid)
+	}
+	if v.NodeID != n.NodeID {
+		return errors.New("version " + vid + " is not a version of " + path)
+	}
+	if v.Attrib.Mode.IsDir() != n.Attrib.Mode.IsDir() {
+		return errors.New("version " + vid + " is of a different type than " + path)
+	}
+
+	if dest == "" || pathpkg.Clean(dest) == nodePath(n) {
+		return restoreInPlace(n, v)
+	}
+	return restoreCopy(root, v, pathpkg.Clean("/" + dest))
+}
+
+/* caller holds lock.LOCK */
+func restoreInPlace(n *MyNode, v *MyNode) error {
+	if !isAllowed(n, "w") {
+		return errors.New(nodePath(n) + " can't be changed")
+	}
+	storeLog.Info("restoring", "path", nodePath(n), "vid", v.Vid)
+
+	/* load everything while the old writers are still on record */
+	if err := AssertExpanded(trace.None, v); err != nil {
+		return err
+	}
+
+	inode := n.Attrib.Inode
+	n.Attrib = v.Attrib
+	n.Attrib.Inode = inode
+	n.Attrib.Mtime = time.Now()
+	if n.Attrib.Mode.IsDir() {
+		n.Kids = make(map[string]*Stub)
+		for k, stub := range v.Kids {
+			n.Kids[k] = stub
+		}
+		n.children = v.children
+		for _, child := range n.children {
+			child.parent = n
+		}
+	} else {
+		n.DataBlocks = v.DataBlocks
+		n.BlockOffsets = v.BlockOffsets
+		n.BlockLengths = v.BlockLengths
+		n.data = v.data
+	}
+	n.expanded = true
+	updateAncestors(n)
+	return nil
+}
+
+/* caller holds lock.LOCK */
+func restoreCopy(root *MyNode, v *MyNode, dest string) error {
+	p := lookupFrom(root, pathpkg.Dir(dest))
+	name := pathpkg.Base(dest)
+	if p == nil || !p.Attrib.Mode.IsDir() {
+		return errors.New(pathpkg.Dir(dest) + " is not a directory")
+	}
+	if !isAllowed(p, "w") {
+		return errors.New(pathpkg.Dir(dest) + " can't be changed")
+	}
+	if _, found := p.children[name]; found || (p.parent == nil && name == SNAPSHOTS_DIR) {
+		return errors.New(dest + " already exists")
+	}
+	storeLog.Info("restoring", "vid", v.Vid, "dest", dest)
+
+	c, err := copyTree(v, name, p)
+	if err != nil {
+		return err
+	}
+	p.children[name] = c
+	updateAncestors(c)
+	return nil
+}
+
+/* copies a version and everything under it into new dirty nodes. caller holds lock.LOCK */
+func copyTree(v *MyNode, name string, parent *MyNode) (*MyNode, error) {
+	if err := AssertExpanded(trace.None, v); err != nil {
+		return nil, err
+	}
+	c := new(MyNode)
+	c.Init(name, v.Attrib.Mode, parent)
+	inode := c.Attrib.Inode
+	c.Attrib = v.Attrib
+	c.Attrib.Inode = inode
+	c.Attrib.Mtime = time.Now()
+
+	if v.Attrib.Mode.IsDir() {
+		for k, child := range v.children {
+			cc, err := copyTree(child, k, c)
+			if err != nil {
+				return nil, err
+			}
+			c.children[k] = cc
+			/* the stub's Vid is filled in when the copy is written back */
+			c.Kids[k] = &Stub{NodeID: cc.NodeID, Name: k, Attrib: cc.Attrib, LastWriter: GetMyPid()}
+		}
+	} else {
+		c.DataBlocks = v.DataBlocks
+		c.BlockOffsets = v.BlockOffsets
+		c.BlockLengths = v.BlockLengths
+		c.data = v.data
+	}
+	c.expanded = true
+	c.dirty = true
+	return c, nil
+}
+
+/* parses the value of RESTORE_XATTR */
+func parseRestoreRequest(value string) (vid string, dest string) {
+	fields := strings.Fields(value)
+	if len(fields) > 0 {
+		vid = fields[0]
+	}
+	if len(fields) > 1 {
+		dest = strings.Join(fields[1:], " ")
+	}
+	return vid, dest
+}
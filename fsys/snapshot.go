@@ -0,0 +1,167 @@
+package fsys
+
+import (
+	"os"
+	"fmt"
+	"sort"
+	"time"
+	"errors"
+	"strings"
+	"encoding/json"
+	"p4/storage"
+	"p4/lock"
+	"p4/trace"
+)
+
+/*
+======================
+SNAPSHOTS
+=======================
+*/
+
+/*
+	A snapshot names the version of a subtree (the whole filesystem by default) at the time it
+	was taken: since a version id covers everything below it, the Vid of the subtree plus the
+	time is all there is to record. Snapshots are kept in the store, so unlike the foo@date
+	archives they survive restarts. Each one shows up read-only as /.snapshots/<name>; mkdir in
+	/.snapshots takes a snapshot of the whole filesystem, rmdir deletes one.
+*/
+
+const SNAPSHOT_KEY string = "SNAP"		/* SNAP:<name> => Snapshot */
+
+/* name of the virtual directory under the root holding the snapshots */
+const SNAPSHOTS_DIR string = ".snapshots"
+
+type Snapshot struct {
+	Name string
+	Path string
+	Vid string
+	LastWriter int
+	Created time.Time
+}
+
+func (s Snapshot) String() string {
+	return fmt.Sprintf("%s: %s at %s (%s)", s.Name, s.Path, s.Created.Format(time.RFC3339), s.Vid)
+}
+
+/* the /.snapshots directory, built the first time it's looked up */
+var snapshotsDir *MyNode
+
+func snapshotKey(name string) []byte {
+	return []byte(fmt.Sprintf("%s:%s", SNAPSHOT_KEY, name))
+}
+
+func validSnapshotName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/@")
+}
+
+/* takes a snapshot of the subtree at path */
+func CreateSnapshot(fs *MyFS, name string, path string) (Snapshot, error) {
+	lock.LOCK.Lock()
+	defer lock.LOCK.Unlock()
+	r, _ := fs.Root()
+	return createSnapshot(r.(*MyNode), name, path)
+}
+
+/* caller holds lock.LOCK */
+func createSnapshot(root *MyNode, name string, path string) (Snapshot, error) {
+	if ReadOnly {
+		return Snapshot{}, ErrReadOnly
+	}
+	if !validSnapshotName(name) {
+		return Snapshot{}, errors.New("invalid snapshot name " + name)
+	}
+	if _, found := GetSnapshot(name); found {
+		return Snapshot{}, errors.New("snapshot " + name + " already exists")
+	}
+
+	/* write back pending changes, so the version exists in the store. the flusher publishes them */
+	if err := writeBack(root); err != nil {
+		return Snapshot{}, err
+	}
+	node := lookupFrom(root, path)
+	if node == nil {
+		return Snapshot{}, errors.New(path + " does not exist")
+	}
+	if node.archive {
+		return Snapshot{}, errors.New(path + " is an archive")
+	}
+
+	snap := Snapshot{name, nodePath(node), node.Vid, node.LastWriter, time.Now()}
+	snapstr, _ := json.Marshal(snap)
+	if err := storage.Put(snapshotKey(name), snapstr); err != nil {
+		return Snapshot{}, err
+	}
+	storeLog.Info("created snapshot", "name", snap.Name, "path", snap.Path, "vid", snap.Vid)
+	return snap, nil
+}
+
+func GetSnapshot(name string) (Snapshot, bool) {
+	snapstr, err := storage.Get(snapshotKey(name))
+	if err != nil {
+		return Snapshot{}, false
+	}
+	var snap Snapshot
+	json.Unmarshal(snapstr, &snap)
+	return snap, true
+}
+
+/* every snapshot, oldest first */
+func GetSnapshots() []Snapshot {
+	list := []Snapshot{}
+	storage.Iterate([]byte(SNAPSHOT_KEY + ":"), func(key []byte, val []byte) bool {
+		var snap Snapshot
+		json.Unmarshal(val, &snap)
+		list = append(list, snap)
+		return true
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+	return list
+}
+
+func DeleteSnapshot(name string) error {
+	if ReadOnly {
+		return ErrReadOnly
+	}
+	if _, found := GetSnapshot(name); !found {
+		return errors.New("no snapshot " + name)
+	}
+	storeLog.Info("deleting snapshot", "name", name)
+	return storage.Delete(snapshotKey(name))
+}
+
+/* the /.snapshots directory of root, up to date with the stored snapshots. caller holds lock.LOCK */
+func getSnapshotsDir(root *MyNode) *MyNode {
+	if snapshotsDir == nil || snapshotsDir.parent != root {
+		snapshotsDir = newVirtualDir(SNAPSHOTS_DIR, os.ModeDir|0555, root)
+	}
+	refreshSnapshotsDir()
+	return snapshotsDir
+}
+
+/* caller holds lock.LOCK */
+func refreshSnapshotsDir() {
+	snaps := make(map[string]Snapshot)
+	for _, snap := range GetSnapshots() {
+		snaps[snap.Name] = snap
+	}
+	for name, child := range snapshotsDir.children {
+		if snap, found := snaps[name]; !found || snap.Vid != child.Vid {
+			delete(snapshotsDir.children, name)
+		}
+	}
+	for name, snap := range snaps {
+		if _, found := snapshotsDir.children[name]; found {
+			continue
+		}
+		node, err := LoadNodeVersion(trace.None, snap.Vid, snap.LastWriter)
+		if err != nil || node.Vid != snap.Vid {
+			storeLog.Warn("could not load snapshot", "name", name, "vid", snap.Vid, "err", err)
+			continue
+		}
+		node.Name = name
+		node.parent = snapshotsDir
+		node.archive = true
+		snapshotsDir.children[name] = node
+	}
+}
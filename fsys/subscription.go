@@ -0,0 +1,140 @@
+package fsys
+
+import (
+	"fmt"
+	"bytes"
+	"strings"
+	"p4/storage"
+	"p4/trace"
+	pathpkg "path"
+)
+
+/*
+======================
+SUBSCRIPTIONS
+=======================
+*/
+
+/*
+	A replica can follow just some subtrees instead of the whole filesystem. Every replica gets
+	and stores the metadata of the whole tree, but only the data of files in the subtrees it
+	follows; the rest is fetched from the writer if and when it is read. Every published frame
+	starts with a topic and a 0 byte: versions, heartbeats and gossip go out with the empty
+	topic, the data a replica writes goes out one chunk per frame with the file's path as topic.
+	Subscribing to subtree S means the topic prefixes "\x00" (everything with the empty topic),
+	"S\x00" (S itself) and "S/" (anything below S). Data that didn't arrive that way, e.g. with
+	updates fetched from the log, is fetched right after the update for subscribed files.
+*/
+
+/* subtrees this replica follows. "/" means everything */
+var Subscriptions []string = []string{"/"}
+
+func SetSubscriptions(paths []string) {
+	Subscriptions = []string{}
+	for _, p := range paths {
+		p = pathpkg.Clean("/" + strings.TrimSpace(p))
+		if p == "/" {
+			Subscriptions = []string{"/"}
+			return
+		}
+		Subscriptions = append(Subscriptions, p)
+	}
+	if len(Subscriptions) == 0 {
+		Subscriptions = []string{"/"}
+	}
+	netLog.Info("subscribed", "paths", Subscriptions)
+}
+
+/* true if path is a subscribed subtree or inside one */
+func isSubscribed(path string) bool {
+	for _, s := range Subscriptions {
+		if s == "/" || path == s || strings.HasPrefix(path, s + "/") {
+			return true
+		}
+	}
+	return false
+}
+
+/* topic prefixes to subscribe to */
+func subscriptionTopics() [][]byte {
+	if len(Subscriptions) == 1 && Subscriptions[0] == "/" {
+		return [][]byte{[]byte{}}
+	}
+	topics := map[string]bool{"\x00": true}
+	for _, s := range Subscriptions {
+		topics[s + "\x00"] = true
+		topics[s + "/"] = true
+	}
+	list := [][]byte{}
+	for t := range topics {
+		list = append(list, []byte(t))
+	}
+	return list
+}
+
+func topicFrame(topic string, body []byte) []byte {
+	return append([]byte(topic + "\x00"), body...)
+}
+
+/* splits a frame into its topic and its body */
+func splitFrame(frame []byte) (string, []byte) {
+	i := bytes.IndexByte(frame, 0)
+	if i < 0 {
+		return "", frame
+	}
+	return string(frame[:i]), frame[i + 1:]
+}
+
+/* publishes the chunks of the files written here that weren't published with an earlier version. caller holds lock.LOCK */
+func sendUpdateData(entry LogEntry) {
+	sent := make(map[string]bool)
+	for path, v := range entry.Versions {
+		if v.Attrib.Mode.IsDir() || v.LastWriter != GetMyPid() {
+			continue
+		}
+		for _, hash := range v.DataBlocks {
+			if _, queued := getChunkReplicas(hash); queued || sent[hash] {
+				continue
+			}
+			data, err := storage.Get([]byte(fmt.Sprintf("%s:%v", DATA_KEY, hash)))
+			if err != nil {
+				continue
+			}
+			m := Message{}
+			m.Type = UPDATE_DATA
+			m.From = Pid
+			m.PushedHash = hash
+			m.PushedData = data
+			publishTopic(path, m)
+			sent[hash] = true
+		}
+	}
+}
+
+/* stores a chunk of the subscribed file at path. it is cached: collected again if the file is no longer followed */
+func receiveUpdateData(msg Message, path string) {
+	if hasDataChunk(msg.PushedHash) {
+		return
+	}
+	if !chunkMatches(msg.PushedHash, msg.PushedData) {
+		netLog.Warn("dropping published chunk, hash does not match", "chunk", msg.PushedHash, "peer", msg.From)
+		return
+	}
+	storage.Put([]byte(fmt.Sprintf("%s:%v", DATA_KEY, msg.PushedHash)), msg.PushedData)
+	markCached(msg.PushedHash, path)
+}
+
+/* fetches the data of every subscribed file in an update, so it's there when we go offline */
+func prefetchData(versions map[string]MyNode) {
+	for path, v := range versions {
+		if v.Attrib.Mode.IsDir() || !isSubscribed(path) || v.LastWriter == GetMyPid() {
+			continue
+		}
+		for _, hash := range v.DataBlocks {
+			/* whatever fails is fetched when it's read */
+			if _, err := loadDataChunk(trace.None, hash, v.LastWriter, path); err != nil {
+				netLog.Debug("prefetch failed", "path", path, "chunk", hash, "err", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package fsys
+
+import (
+	"bytes"
+	"testing"
+)
+
+/* true if a frame published on topic reaches a subscriber of topics, as the transports match prefixes */
+func reaches(topics [][]byte, topic string) bool {
+	frame := topicFrame(topic, []byte("{}"))
+	for _, t := range topics {
+		if bytes.HasPrefix(frame, t) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestSubscriptionTopics(t *testing.T) {
+	saved := Subscriptions
+	t.Cleanup(func() { Subscriptions = saved })
+
+	SetSubscriptions([]string{"/"})
+	for _, topic := range []string{"", "/a", "/b/c"} {
+		if !reaches(subscriptionTopics(), topic) {
+			t.Errorf("subscribed to everything but not to %q", topic)
+		}
+	}
+
+	SetSubscriptions([]string{"projects/mine/", " /docs"})
+	topics := subscriptionTopics()
+	cases := map[string]bool{
+		"": true,	/* metadata goes to everyone */
+		"/projects/mine": true,
+		"/projects/mine/a.txt": true,
+		"/docs/x/y": true,
+		"/projects": false,
+		"/projects/mine2/a.txt": false,
+		"/documents": false,
+	}
+	for topic, want := range cases {
+		if got := reaches(topics, topic); got != want {
+			t.Errorf("data for %q reaches a subscriber of %v: %v, want %v", topic, Subscriptions, got, want)
+		}
+	}
+}
+
+func TestTopicFrames(t *testing.T) {
+	for _, topic := range []string{"", "/a/b"} {
+		body := []byte(`{"Type":16}`)
+		gotTopic, gotBody := splitFrame(topicFrame(topic, body))
+		if gotTopic != topic || !bytes.Equal(gotBody, body) {
+			t.Errorf("frame on %q split into %q and %q", topic, gotTopic, gotBody)
+		}
+	}
+	/* frames from before topics are all body */
+	if topic, body := splitFrame([]byte("{}")); topic != "" || string(body) != "{}" {
+		t.Errorf("frame without a topic split into %q and %q", topic, body)
+	}
+}
@@ -0,0 +1,58 @@
+package fsys
+
+import (
+	"time"
+	"p4/trace"
+)
+
+/*
+======================
+TRACING
+=======================
+*/
+
+/*
+	Spans are recorded for FUSE operations, AssertExpanded, requests to peers and merges, and
+	the span context travels in every request (Message.Trace), so a read that waits on a peer
+	shows the peer's side as part of the same trace. Functions that may end up asking a peer
+	take the context of the span to record under as their first argument; trace.None starts
+	a new trace.
+*/
+
+/* exports spans to spec, a file or otlp://host:port (see trace.NewExporter) */
+func StartTracing(spec string) error {
+	e, err := trace.NewExporter(spec)
+	if err != nil {
+		return err
+	}
+	trace.Service = "gofs/" + ServerName
+	trace.SetExporter(e)
+	netLog.Info("tracing", "to", spec)
+	return nil
+}
+
+/* exports what is still buffered and stops recording */
+func StopTracing() {
+	trace.SetExporter(nil)
+}
+
+/* a FUSE operation in progress: its span, and when it started for the metrics */
+type fuseOp struct {
+	name string
+	start time.Time
+	span *trace.Span
+}
+
+/* use as: op := startOp("read", n); defer op.end() */
+func startOp(name string, n *MyNode) *fuseOp {
+	return &fuseOp{name, time.Now(), trace.Start(trace.None, "fuse " + name, "node", n.Name)}
+}
+
+func (op *fuseOp) context() trace.SpanContext {
+	return op.span.Context()
+}
+
+func (op *fuseOp) end() {
+	observeOp(op.name, op.start)
+	op.span.End()
+}
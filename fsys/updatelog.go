@@ -0,0 +1,358 @@
+package fsys
+
+import (
+	"fmt"
+	"time"
+	"sync"
+	"strconv"
+	"strings"
+	"encoding/json"
+	"p4/storage"
+	"p4/lock"
+	"p4/trace"
+)
+
+/*
+======================
+UPDATE LOG
+=======================
+*/
+
+/*
+	Every batch of versions the flusher publishes is first appended to an on-disk log under a
+	sequence number. Subscribers remember the last sequence number they applied from each
+	publisher, acknowledge it, and ask for whatever they skipped. An entry is dropped once every
+	known peer has acknowledged it, except that a peer down for longer than LOG_RETENTION_DOWN
+	no longer holds the log back and the log never keeps more than MAX_LOG_ENTRIES. A peer that
+	comes back after its entries were dropped skips them: the versions they carried are still
+	reachable from the later ones and are fetched when used.
+*/
+
+/* namespaces for the update log */
+const UPDATE_LOG_KEY string = "ULOG"			/* ULOG:<seq> => LogEntry */
+const UPDATE_LOG_META_KEY string = "ULOG_META"	/* epoch and head of the local log */
+const UPDATE_ACK_KEY string = "ULOG_ACK"		/* ULOG_ACK:<pid> => last seq of the local log acknowledged by pid */
+const UPDATE_RECV_KEY string = "ULOG_RECV"		/* ULOG_RECV:<pid> => last seq of pid's log applied here */
+
+/* max number of entries handed out per UPDATE_REQUEST */
+const MAX_REPLAY_ENTRIES int = 64
+
+/* bounds on what is kept for peers that don't acknowledge */
+const LOG_RETENTION_DOWN = 10 * time.Minute
+const MAX_LOG_ENTRIES uint64 = 10000
+
+type LogEntry struct {
+	Seq uint64
+	Versions map[string]MyNode
+}
+
+/* the epoch changes whenever a log is created from scratch (e.g. -newfs), so stale positions can be detected */
+type LogPosition struct {
+	Epoch string
+	Seq uint64
+}
+
+/* position of the local log. protected by logLock */
+var logHead LogPosition
+var logLock sync.Mutex
+
+/* last entry applied from each publisher. protected by lock.LOCK */
+var lastApplied map[int]LogPosition
+
+func logKey(seq uint64) []byte {
+	return []byte(fmt.Sprintf("%s:%020d", UPDATE_LOG_KEY, seq))
+}
+
+func LoadUpdateLog() {
+	logLock.Lock()
+	defer logLock.Unlock()
+
+	headstr, err := storage.Get([]byte(UPDATE_LOG_META_KEY))
+	if err != nil {
+		/* no log yet, start a new epoch */
+		logHead = LogPosition{fmt.Sprintf("%d-%x", Pid, time.Now().UnixNano()), 0}
+		saveLogHead()
+	} else {
+		json.Unmarshal(headstr, &logHead)
+	}
+	storeLog.Info("update log", "epoch", logHead.Epoch, "seq", logHead.Seq)
+
+	lastApplied = make(map[int]LogPosition)
+	storage.Iterate([]byte(UPDATE_RECV_KEY + ":"), func(key []byte, val []byte) bool {
+		pid, _ := strconv.Atoi(strings.TrimPrefix(string(key), UPDATE_RECV_KEY + ":"))
+		var pos LogPosition
+		json.Unmarshal(val, &pos)
+		lastApplied[pid] = pos
+		return true
+	})
+}
+
+func saveLogHead() error {
+	headstr, _ := json.Marshal(logHead)
+	return storage.Put([]byte(UPDATE_LOG_META_KEY), headstr)
+}
+
+func GetLogHead() LogPosition {
+	logLock.Lock()
+	defer logLock.Unlock()
+	return logHead
+}
+
+/* persists a batch of versions as the next entry of the local log */
+func AppendUpdate(versions map[string]MyNode) (LogEntry, error) {
+	logLock.Lock()
+	defer logLock.Unlock()
+
+	/* copy, the caller is free to clear its map once this returns */
+	entry := LogEntry{logHead.Seq + 1, make(map[string]MyNode)}
+	for k, v := range versions {
+		entry.Versions[k] = v
+	}
+
+	entrystr, _ := json.Marshal(entry)
+	if err := storage.Put(logKey(entry.Seq), entrystr); err != nil {
+		return entry, err
+	}
+	logHead.Seq = entry.Seq
+	if err := saveLogHead(); err != nil {
+		return entry, err
+	}
+	trimLog()
+	return entry, nil
+}
+
+/* returns up to MAX_REPLAY_ENTRIES entries of the local log starting at seq `from` */
+func ReadUpdates(from uint64) []LogEntry {
+	entries := []LogEntry{}
+	storage.Iterate([]byte(UPDATE_LOG_KEY + ":"), func(key []byte, val []byte) bool {
+		seq, _ := strconv.ParseUint(strings.TrimPrefix(string(key), UPDATE_LOG_KEY + ":"), 10, 64)
+		if seq < from {
+			return true
+		}
+		var entry LogEntry
+		json.Unmarshal(val, &entry)
+		entries = append(entries, entry)
+		return len(entries) < MAX_REPLAY_ENTRIES
+	})
+	return entries
+}
+
+func ackedBy(pid int) uint64 {
+	ackstr, err := storage.Get([]byte(fmt.Sprintf("%s:%d", UPDATE_ACK_KEY, pid)))
+	if err != nil {
+		return 0
+	}
+	var pos LogPosition
+	json.Unmarshal(ackstr, &pos)
+	if pos.Epoch != logHead.Epoch {
+		return 0
+	}
+	return pos.Seq
+}
+
+/* returns the lowest sequence number acknowledged by every peer that isn't long gone. caller holds logLock */
+func lowestAck() uint64 {
+	lowest := logHead.Seq
+	for _, m := range GetPeers() {
+		if downFor(m.Pid) > LOG_RETENTION_DOWN {
+			continue
+		}
+		if acked := ackedBy(m.Pid); acked < lowest {
+			lowest = acked
+		}
+	}
+	return lowest
+}
+
+/* drops the entries no peer waits for any more, and the oldest ones past MAX_LOG_ENTRIES. caller holds logLock */
+func trimLog() {
+	lowest := lowestAck()
+	if logHead.Seq > MAX_LOG_ENTRIES && lowest < logHead.Seq - MAX_LOG_ENTRIES {
+		netLog.Warn("update log full, dropping entries not every peer has", "from", lowest + 1, "to", logHead.Seq - MAX_LOG_ENTRIES)
+		lowest = logHead.Seq - MAX_LOG_ENTRIES
+	}
+	storage.Iterate([]byte(UPDATE_LOG_KEY + ":"), func(key []byte, val []byte) bool {
+		seq, _ := strconv.ParseUint(strings.TrimPrefix(string(key), UPDATE_LOG_KEY + ":"), 10, 64)
+		if seq > lowest {
+			return false
+		}
+		storage.Delete(key)
+		return true
+	})
+}
+
+/* records that `pid` has applied the local log up to pos.Seq, and drops entries everyone has */
+func RecordAck(pid int, pos LogPosition) {
+	logLock.Lock()
+	defer logLock.Unlock()
+
+	if pos.Epoch != logHead.Epoch || pos.Seq > logHead.Seq {
+		netLog.Debug("ignoring stale ack", "peer", pid, "epoch", pos.Epoch, "seq", pos.Seq, "head", logHead.Seq)
+		return
+	}
+	ackstr, _ := json.Marshal(pos)
+	storage.Put([]byte(fmt.Sprintf("%s:%d", UPDATE_ACK_KEY, pid)), ackstr)
+	trimLog()
+}
+
+/* true if some peer hasn't acknowledged the whole local log yet */
+func HasUnackedUpdates() bool {
+	logLock.Lock()
+	defer logLock.Unlock()
+	return lowestAck() < logHead.Seq
+}
+
+
+/* next sequence number expected from publisher `from`. caller holds lock.LOCK */
+func expectedSeq(from int, epoch string) uint64 {
+	pos := lastApplied[from]
+	if pos.Epoch != epoch {
+		/* the publisher's log was recreated, start over */
+		return 1
+	}
+	return pos.Seq + 1
+}
+
+/* merges a log entry and remembers it was applied. caller holds lock.LOCK */
+func applyLogEntry(parent trace.SpanContext, from int, epoch string, entry LogEntry, fs *MyFS) {
+	Merge(parent, entry.Versions, fs)
+	go prefetchData(entry.Versions)
+	setApplied(from, LogPosition{epoch, entry.Seq})
+}
+
+/* caller holds lock.LOCK */
+func setApplied(from int, pos LogPosition) {
+	lastApplied[from] = pos
+	posstr, _ := json.Marshal(pos)
+	storage.Put([]byte(fmt.Sprintf("%s:%d", UPDATE_RECV_KEY, from)), posstr)
+}
+
+/* handles an UPDATE_BROADCAST or UPDATE_HEAD published by msg.From */
+func receiveUpdate(msg Message, fs *MyFS) {
+	lock.LOCK.Lock()
+	next := expectedSeq(msg.From, msg.LogEpoch)
+	if msg.Type == UPDATE_BROADCAST && msg.Seq == next {
+		applyLogEntry(msg.Trace, msg.From, msg.LogEpoch, LogEntry{msg.Seq, msg.Versions}, fs)
+		next++
+	}
+	lock.LOCK.Unlock()
+
+	if msg.Seq >= next {
+		netLog.Info("missed updates", "peer", msg.From, "expected", next, "seq", msg.Seq)
+		startCatchUp(msg.From, fs)
+	} else {
+		go sendAck(msg.From)
+	}
+}
+
+/* publishers being caught up with, and whether they asked for it again meanwhile. protected by catchUpLock */
+var catchingUp map[int]bool = make(map[int]bool)
+var catchUpLock sync.Mutex
+
+/*
+	Catches up with publisher pid in the background, so that waiting on it doesn't hold up
+	the updates of the others, then acknowledges. One catch-up per publisher runs at a time;
+	asking while one runs makes it go round once more.
+*/
+func startCatchUp(pid int, fs *MyFS) {
+	catchUpLock.Lock()
+	defer catchUpLock.Unlock()
+	if again, running := catchingUp[pid]; running {
+		if !again {
+			catchingUp[pid] = true
+		}
+		return
+	}
+	catchingUp[pid] = false
+	go func() {
+		for {
+			if CatchUp(pid, fs) == nil {
+				sendAck(pid)
+			}
+			catchUpLock.Lock()
+			if !catchingUp[pid] {
+				delete(catchingUp, pid)
+				catchUpLock.Unlock()
+				return
+			}
+			catchingUp[pid] = false
+			catchUpLock.Unlock()
+		}
+	}()
+}
+
+/* asks publisher `pid` for every log entry not applied here yet and applies them in order */
+func CatchUp(pid int, fs *MyFS) (err error) {
+	span := trace.Start(trace.None, "CatchUp", "peer", writerName(pid))
+	defer func() {
+		span.SetError(err)
+		span.End()
+	}()
+	dest := GetEndpointFromPid(pid)
+	for {
+		lock.LOCK.Lock()
+		pos := lastApplied[pid]
+		lock.LOCK.Unlock()
+
+		m := Message{}
+		m.Type = UPDATE_REQUEST
+		m.From = Pid
+		m.LogEpoch = pos.Epoch
+		m.Seq = pos.Seq + 1
+		m.Trace = span.Context()
+		reply, err := sendRequest(m, dest)
+		if err != nil {
+			netLog.Warn("catch up failed", "peer", pid, "err", err)
+			return err
+		}
+		if reply.Type != UPDATE_REPLY {
+			return fmt.Errorf("unexpected reply %d to update request", reply.Type)
+		}
+		if reply.LogEpoch != pos.Epoch {
+			/* the request was made against an old epoch, ask again from the start */
+			m.Seq = 1
+			if reply, err = sendRequest(m, dest); err != nil {
+				return err
+			}
+		}
+
+		lock.LOCK.Lock()
+		for _, entry := range reply.Entries {
+			next := expectedSeq(pid, reply.LogEpoch)
+			if entry.Seq < next {
+				continue
+			}
+			if entry.Seq > next {
+				/* the publisher dropped them already, they are gone for good: move forward */
+				netLog.Warn("updates lost", "peer", pid, "from", next, "to", entry.Seq - 1)
+			}
+			applyLogEntry(span.Context(), pid, reply.LogEpoch, entry, fs)
+		}
+		if next := expectedSeq(pid, reply.LogEpoch); len(reply.Entries) == 0 && reply.Seq >= next {
+			netLog.Warn("updates lost", "peer", pid, "from", next, "to", reply.Seq)
+			setApplied(pid, LogPosition{reply.LogEpoch, reply.Seq})
+		}
+		lock.LOCK.Unlock()
+
+		netLog.Info("caught up", "peer", pid, "entries", len(reply.Entries))
+		if len(reply.Entries) < MAX_REPLAY_ENTRIES {
+			return nil
+		}
+	}
+}
+
+/* tells publisher `pid` how far its log has been applied here */
+func sendAck(pid int) {
+	lock.LOCK.Lock()
+	pos := lastApplied[pid]
+	lock.LOCK.Unlock()
+
+	m := Message{}
+	m.Type = UPDATE_ACK
+	m.From = Pid
+	m.LogEpoch = pos.Epoch
+	m.Seq = pos.Seq
+	if _, err := sendRequest(m, GetEndpointFromPid(pid)); err != nil {
+		netLog.Debug("ack failed", "peer", pid, "err", err)
+	}
+}
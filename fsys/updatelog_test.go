@@ -0,0 +1,83 @@
+package fsys
+
+import (
+	"testing"
+)
+
+func testVersion(pid int, counter int, name string, vid string) MyNode {
+	return MyNode{NodeID: makeNodeID(pid, counter), Vid: vid, Name: name, LastWriter: pid}
+}
+
+/* a peer's updates are applied in order, missed ones are caught up with, and all of them acknowledged */
+func TestUpdateLogCatchUp(t *testing.T) {
+	fs := startTestReplica(t)
+	peer := newTestPeer(t, 2)
+	MergeMembers([]Member{peer.member})
+
+	/* published before anyone listened: picked up when subscribing */
+	peer.appendLog(map[string]MyNode{"/a": testVersion(2, 1, "a", "a1")})
+	startTestSub(t, fs, peer)
+	peer.waitFor(t, UPDATE_ACK, func(m Message) bool { return m.Seq == 1 })
+
+	/* the next one in sequence is applied as it comes */
+	e := peer.appendLog(map[string]MyNode{"/a": testVersion(2, 1, "a", "a2")})
+	peer.publish(Message{Type: UPDATE_BROADCAST, LogEpoch: peer.epoch, Seq: e.Seq, Versions: e.Versions})
+	ack := peer.waitFor(t, UPDATE_ACK, nil)
+	if ack.Seq != 2 || ack.LogEpoch != peer.epoch {
+		t.Fatalf("acknowledged %s/%d, want %s/2", ack.LogEpoch, ack.Seq, peer.epoch)
+	}
+
+	/* two missed, then the head is announced: the replica asks for what it lacks */
+	peer.appendLog(map[string]MyNode{"/b": testVersion(2, 2, "b", "b1")})
+	peer.appendLog(map[string]MyNode{"/a": testVersion(2, 1, "a", "a3")})
+	peer.publish(Message{Type: UPDATE_HEAD, LogEpoch: peer.epoch, Seq: 4})
+	req := peer.waitFor(t, UPDATE_REQUEST, nil)
+	if req.Seq != 3 {
+		t.Errorf("asked for updates from %d, want 3", req.Seq)
+	}
+	peer.waitFor(t, UPDATE_ACK, func(m Message) bool { return m.Seq == 4 })
+
+	want := map[int][]string{makeNodeID(2, 1): {"a1", "a2", "a3"}, makeNodeID(2, 2): {"b1"}}
+	for id, vids := range want {
+		got := GetNodeVersions(id)
+		if len(got) != len(vids) {
+			t.Errorf("versions of node %d: %v, want %v", id, got, vids)
+			continue
+		}
+		for i := range vids {
+			if got[i] != vids[i] {
+				t.Errorf("versions of node %d: %v, want %v", id, got, vids)
+			}
+		}
+	}
+}
+
+/* the replica serves its own log to a peer catching up, and drops entries once everyone has them */
+func TestUpdateLogServesAndTrims(t *testing.T) {
+	startTestReplica(t)
+	peer := newTestPeer(t, 2)
+	MergeMembers([]Member{peer.member})
+
+	AppendUpdate(map[string]MyNode{"/a": testVersion(1, 1, "a", "a1")})
+	AppendUpdate(map[string]MyNode{"/b": testVersion(1, 2, "b", "b1")})
+	head := GetLogHead()
+
+	reply := peer.request(t, Message{Type: UPDATE_REQUEST, LogEpoch: head.Epoch, Seq: 2})
+	if reply.Type != UPDATE_REPLY || reply.LogEpoch != head.Epoch || reply.Seq != 2 {
+		t.Fatalf("reply %d at %s/%d, want UPDATE_REPLY at %s/2", reply.Type, reply.LogEpoch, reply.Seq, head.Epoch)
+	}
+	if len(reply.Entries) != 1 || reply.Entries[0].Versions["/b"].Vid != "b1" {
+		t.Errorf("entries from 2: %+v, want the one with b1", reply.Entries)
+	}
+	if !HasUnackedUpdates() {
+		t.Error("no unacknowledged updates before the peer acknowledged")
+	}
+
+	peer.request(t, Message{Type: UPDATE_ACK, LogEpoch: head.Epoch, Seq: 2})
+	if HasUnackedUpdates() {
+		t.Error("unacknowledged updates left after the peer acknowledged all")
+	}
+	if entries := ReadUpdates(1); len(entries) != 0 {
+		t.Errorf("kept %d entries everyone has", len(entries))
+	}
+}
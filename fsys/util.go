@@ -5,7 +5,8 @@ import (
 	"encoding/json"
 	"crypto/sha1"
 	"time"
-	"p4/util"
+	"strings"
+	"p4/trace"
 )
 
 
@@ -13,6 +14,7 @@ import (
 func updateAncestors(node *MyNode) {
 	current := node
 	for current != nil {
+		reattach(current)
 		current.Vid = GenerateVersionId(current)	/* update vid */
 		current.LastWriter = GetMyPid()				/* update last writer */
 		if current.parent != nil {
@@ -24,28 +26,37 @@ func updateAncestors(node *MyNode) {
 			current.parent.Kids[current.Name].LastWriter = GetMyPid()
 		}
 		SaveNodeVersion(current)
-		util.P_out("%s dirty = %v", current.Name, current.dirty)
-		dirtyNodesList[node.Vid] = *node
+		fuseLog.Debug("dirty", "node", current.Name, "vid", current.Vid)
+		dirtyNodesList[nodePath(node)] = *node
 		current = current.parent
 	}
+	dirtyNodes.Set(float64(len(dirtyNodesList)))
+	noteWrite()
 }
 
+/*
+	A version id is the hash of the node's metadata, which includes the previous version id and
+	the version ids of its children, so it names exactly one version of the node and everything
+	under it.
+*/
 func GenerateVersionId(node *MyNode) string {
-	path := ""
-	current := node
-	for current != nil {
-		path += current.Name
-		path += "/"
-		current = current.parent
-	}
-	util.P_out("version for %s = %s", node.Name, path)
-	return path
 	str, _ := json.Marshal(*node)
-	util.P_out("json=%s", str)
 	hash := sha1.Sum(str)
 	return hex.EncodeToString(hash[:])
 }
 
+/* absolute path of a node, e.g. /projects/mine/a.txt. updates are matched up with local nodes by path */
+func nodePath(node *MyNode) string {
+	if node.parent == nil {
+		return "/"
+	}
+	names := []string{}
+	for current := node; current.parent != nil; current = current.parent {
+		names = append([]string{current.Name}, names...)
+	}
+	return "/" + strings.Join(names, "/")
+}
+
 func parseTime(date string) time.Time {
 	t, boolerr := peteTime(date)
 	var finalTime time.Time
@@ -53,7 +64,7 @@ func parseTime(date string) time.Time {
 		/* its of the form: foo@-1m */
 		duration, _ := time.ParseDuration(date)
 		finalTime = time.Now().Add(duration)
-		util.P_out("duration based final time: %v", finalTime)
+		fuseLog.Debug("duration based archive time", "time", finalTime)
 	} else {
 		/* its of the form: foo@2014-09-18 9:20 */
 		finalTime = t
@@ -89,7 +100,8 @@ func peteTime(s string) (time.Time, bool) {
 func isAllowed(node *MyNode, operation string) bool {
 	switch(operation) {
 		case "w": {
-			current := node.parent
+			/* nothing in or under an archive or a snapshot can be changed */
+			current := node
 			for current != nil {
 				if current.archive {
 					return false
@@ -98,8 +110,7 @@ func isAllowed(node *MyNode, operation string) bool {
 			}
 			return true
 			if (node.Attrib.Mode.Perm() & 0x00000092) <= 0 {
-				util.P_out("%s => %v", node.Name, node.Attrib.Mode.Perm())
-				util.P_out(">>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>>> WRITE PERM DENIED!")
+				fuseLog.Debug("write not allowed", "node", node.Name, "mode", node.Attrib.Mode)
 			}
 			return (node.Attrib.Mode.Perm() & 0x00000092) > 0
 		}
@@ -110,3 +121,46 @@ func isAllowed(node *MyNode, operation string) bool {
 	}
 	return false
 }
+
+/* finds the node at an absolute path, expanding directories on the way. caller holds lock.LOCK */
+func lookupPath(fs *MyFS, path string) *MyNode {
+	r, _ := fs.Root()
+	return lookupFrom(r.(*MyNode), path)
+}
+
+/* finds the node at a path relative to root. caller holds lock.LOCK */
+func lookupFrom(root *MyNode, path string) *MyNode {
+	current := root
+	for _, name := range strings.Split(path, "/") {
+		if name == "" {
+			continue
+		}
+		current.checkForUpdates()
+		if err := AssertExpanded(trace.None, current); err != nil {
+			fuseLog.Debug("lookup failed", "path", path, "err", err)
+			return nil
+		}
+		child, found := current.children[name]
+		if !found {
+			return nil
+		}
+		current = child
+	}
+	return current
+}
+
+/* calls fn on node and everything below it, expanding directories but not loading file data. caller holds lock.LOCK */
+func walkTree(node *MyNode, fn func(n *MyNode)) {
+	node.checkForUpdates()
+	fn(node)
+	if node.Attrib.Mode.IsDir() && !node.archive {
+		if err := AssertExpanded(trace.None, node); err != nil {
+			/* what can't be loaded now is skipped */
+			fuseLog.Debug("walk skipped a directory", "node", node.Name, "err", err)
+			return
+		}
+		for _, child := range node.children {
+			walkTree(child, fn)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package fsys
+
+import (
+	"fmt"
+	"strings"
+	"crypto/sha1"
+	"encoding/hex"
+	"p4/storage"
+	"p4/lock"
+)
+
+/*
+======================
+VERIFY
+=======================
+*/
+
+/*
+	Checks that every stored chunk still hashes to its name, and that every chunk used under
+	path that this replica wrote itself is stored: those can't be fetched from anywhere else.
+*/
+
+type VerifyResult struct {
+	Chunks int
+	Corrupt []string	/* stored chunks whose contents don't match their hash */
+	Missing []string	/* chunks written here that aren't stored anymore */
+}
+
+func VerifyChunks(fs *MyFS, path string) (VerifyResult, error) {
+	res := VerifyResult{0, []string{}, []string{}}
+	prefix := DATA_KEY + ":"
+	storage.Iterate([]byte(prefix), func(key []byte, val []byte) bool {
+		res.Chunks++
+		hash := strings.TrimPrefix(string(key), prefix)
+		sum := sha1.Sum(val)
+		if hex.EncodeToString(sum[:]) != hash {
+			res.Corrupt = append(res.Corrupt, hash)
+		}
+		return true
+	})
+
+	lock.LOCK.Lock()
+	defer lock.LOCK.Unlock()
+	node := lookupPath(fs, path)
+	if node == nil {
+		return res, fmt.Errorf("%s does not exist", path)
+	}
+	for _, ref := range chunksUnder(node) {
+		if ref.lastWriter == GetMyPid() && !hasDataChunk(ref.hash) {
+			res.Missing = append(res.Missing, ref.hash)
+		}
+	}
+	return res, nil
+}
@@ -9,10 +9,14 @@ import (
 	"os"
 	"log"
 	"os/signal"
+	"strings"
+	"syscall"
 	"p4/storage"
 	"p4/util"
 	"p4/lock"
 	"p4/fsys"
+	"p4/transport"
+	"p4/ctl"
 )
 
 
@@ -24,6 +28,7 @@ MAIN FUNCTION
 
 /* memfs implements a simple in-memory file system */
 
+var mainLog = util.Logger(util.LOG_MAIN)
 
 var Usage = func() {
 	fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
@@ -33,12 +38,46 @@ var Usage = func() {
 
 func main() {
 	flag.Usage = Usage
-	debugPtr := flag.Bool("debug", false, "print lots of stuff")
+	debugPtr := flag.Bool("debug", false, "log everything, same as -log debug")
+	logPtr := flag.String("log", "info", "log levels, for every subsystem or per subsystem: e.g. warn,network=debug")
+	logfilePtr := flag.String("logfile", "", "also log to this file, as JSON")
 	namePtr := flag.String("name", "auto", "replica name")
 	newfsPtr := flag.Bool("newfs", false, "reinitialize local filesystem")
+	joinPtr := flag.String("join", "", "host:port of a running replica to join through")
+	keyfilePtr := flag.String("keyfile", "", "file holding this replica's curve secret key (enables authentication)")
+	genkeyPtr := flag.Bool("genkey", false, "print a new curve key pair and exit")
+	subscribePtr := flag.String("subscribe", "/", "comma separated subtrees whose data is replicated, the rest is fetched on demand")
+	readonlyPtr := flag.Bool("readonly", false, "mount read-only: follow and serve the filesystem but never change it")
+	headlessPtr := flag.Bool("headless", false, "don't mount, only hold and serve data for the other replicas")
+	replicasPtr := flag.Int("replicas", 1, "how many replicas keep each chunk, unless a subtree sets user.gofs.replicas")
+	fsckPtr := flag.Bool("fsck", false, "check the local store and exit, without mounting")
+	repairPtr := flag.Bool("repair", false, "with -fsck, fetch what is missing or damaged from the peers")
+	flushPtr := flag.String("flush", "5s", "how often changes are written back and published, or adaptive: soon after writes pause, at most every 5s")
+	tracePtr := flag.String("trace", "", "record spans to this file, or to an OTLP/HTTP collector given as otlp://host:port")
+	cachembPtr := flag.Int64("cachemb", 256, "megabytes of file data and directories to keep in memory before collapsing the least recently used (0: no limit)")
+	cachenodesPtr := flag.Int("cachenodes", 100000, "expanded files and directories to keep in memory before collapsing the least recently used (0: no limit)")
+	metricsPtr := flag.String("metrics", "", "host:port to serve Prometheus metrics on at /metrics (off if empty)")
+	transportPtr := flag.String("transport", transport.Default(), fmt.Sprintf("how replicas talk to each other, one of %v", transport.Names()))
 	flag.Parse()
 
-	util.SetDebug(*debugPtr)
+	if *genkeyPtr {
+		public, secret, err := fsys.GenerateKeyPair()
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("public: %s\nsecret: %s\n", public, secret)
+		return
+	}
+
+	if *debugPtr {
+		*logPtr = "debug"
+	}
+	if err := util.SetLogLevels(*logPtr); err != nil {
+		log.Fatal(err)
+	}
+	if err := util.SetLogFile(*logfilePtr); err != nil {
+		log.Fatal(err)
+	}
 
 	util.SetConfigFile(*namePtr)
 	err, serverName, pid, mountpoint, dbpath, hostEndpoint := util.GetConfigDetailsFromName(*namePtr)
@@ -55,43 +94,112 @@ func main() {
 
 	lock.Init()
 
-	/* unmount previously mounted filesystem (if any) */
-	mounterr := os.MkdirAll(mountpoint, os.ModeDir | 0755)
-	util.P_out("mount creation err: %v", mounterr)
-	fuse.Unmount(mountpoint) //!!
-	c, err := fuse.Mount(mountpoint)
-	if err != nil {
+	/* before anything reads the store, fsck included */
+	fsys.SetSubscriptions(strings.Split(*subscribePtr, ","))
+	if err = fsys.UpgradeStore(); err != nil {
 		log.Fatal(err)
 	}
-	defer c.Close()
 
-	endpointList := util.ReadAllEndpoints()
-	fsys.Init(serverName, pid, mountpoint, dbpath, hostEndpoint)
+	if *fsckPtr {
+		os.Exit(fsck(serverName, pid, mountpoint, dbpath, hostEndpoint, *keyfilePtr, *transportPtr, *repairPtr))
+	}
 
-	fsys.StartPub()
-	fsys.StartRep()
-	fsys.StartReq()
+	/* unmount previously mounted filesystem (if any) */
+	var c *fuse.Conn
+	if !*headlessPtr {
+		if mounterr := os.MkdirAll(mountpoint, os.ModeDir | 0755); mounterr != nil {
+			mainLog.Warn("could not create the mountpoint", "path", mountpoint, "err", mounterr)
+		}
+		fuse.Unmount(mountpoint) //!!
+		mountOptions := []fuse.MountOption{}
+		if *readonlyPtr {
+			mountOptions = append(mountOptions, fuse.ReadOnly())
+		}
+		c, err = fuse.Mount(mountpoint, mountOptions...)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer c.Close()
+	}
+
+	fsys.Init(serverName, pid, mountpoint, dbpath, hostEndpoint)
+	fsys.ReadOnly = *readonlyPtr
+	if err = fsys.SetFlushInterval(*flushPtr); err != nil {
+		log.Fatal(err)
+	}
+	fsys.CacheMaxBytes = *cachembPtr << 20
+	fsys.CacheMaxNodes = *cachenodesPtr
 
 	/* create and initialize new custom filesystem */
 	var MyFileSystem = fsys.MyFS{}
 	fsys.SetMyPid(pid)
-	fsys.LoadState()
-	fsys.LoadFS(&MyFileSystem)
-	fsys.StartSub(endpointList, &MyFileSystem)
+	if err = fsys.LoadState(); err != nil {
+		log.Fatal(err)
+	}
+	fsys.LoadUpdateLog()
+	fsys.InitMembership()
 
-	/* serve the filesystem from the mountpoint */
-	go func() {
-		err = fs.Serve(c, MyFileSystem)
-		if err != nil {
+	if *keyfilePtr != "" {
+		if err = fsys.LoadKeyFile(*keyfilePtr); err != nil {
 			log.Fatal(err)
 		}
+	}
+	if err = fsys.InitTransport(*transportPtr); err != nil {
+		log.Fatal(err)
+	}
+	if err = fsys.StartPub(); err != nil {
+		log.Fatal(err)
+	}
+	fsys.StartRep()
 
-		/* check if the mount process has an error to report */
-		<-c.Ready
-		if err := c.MountError; err != nil {
+	if *joinPtr != "" {
+		seed, err := util.ParseEndpoint(*joinPtr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err = fsys.JoinCluster(seed); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err = fsys.LoadFS(&MyFileSystem); err != nil {
+		log.Fatal(err)
+	}
+	fsys.DefaultReplicas = *replicasPtr
+	fsys.StartSub(&MyFileSystem)
+	backgroundQuitter := make(chan bool)
+	fsys.StartGossip(backgroundQuitter)
+	fsys.StartHeartbeat(backgroundQuitter)
+	fsys.StartPinner(backgroundQuitter, &MyFileSystem)
+	fsys.StartReplicator(backgroundQuitter)
+	if err = fsys.StartControl(ctl.SocketPath(dbpath), &MyFileSystem); err != nil {
+		mainLog.Warn("no control socket", "err", err)
+	}
+	if *tracePtr != "" {
+		if err = fsys.StartTracing(*tracePtr); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if *metricsPtr != "" {
+		if err = fsys.StartMetrics(*metricsPtr); err != nil {
 			log.Fatal(err)
 		}
-	}()
+	}
+
+	/* serve the filesystem from the mountpoint. headless, it is only served to the other replicas */
+	if !*headlessPtr {
+		go func() {
+			err = fs.Serve(c, MyFileSystem)
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			/* check if the mount process has an error to report */
+			<-c.Ready
+			if err := c.MountError; err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
 
 
 	/* start the flusher */
@@ -101,15 +209,50 @@ func main() {
 
 	/* gracefully end the system */
 	sigchan := make(chan os.Signal)
-	signal.Notify(sigchan, os.Interrupt)	// die on interrupt
+	signal.Notify(sigchan, os.Interrupt, syscall.SIGTERM)	// die on interrupt, or when stopped as a daemon
 	<-sigchan
-	util.P_out("received interrupt")
-	util.P_out("ending flusher (could take a few seconds)")
+	mainLog.Info("received interrupt")
+	close(backgroundQuitter)
+	fsys.LeaveCluster()
+	mainLog.Info("ending flusher (could take a few seconds)")
 	writeBackQuitter <- true
-	util.P_out("ending filesystem serve")
-	util.P_out("In order to gracefully unmount, the filesystem should not be in use (otherwise it will block)")
-	fuse.Unmount(mountpoint)
-	c.Close()
-	util.P_out("ended filesystem serve")
+	if !*headlessPtr {
+		mainLog.Info("ending filesystem serve. to unmount gracefully, the filesystem must not be in use (otherwise it blocks)", "mountpoint", mountpoint)
+		fuse.Unmount(mountpoint)
+		c.Close()
+		mainLog.Info("ended filesystem serve")
+	}
+	fsys.StopTracing()
 	os.Exit(0)
 }
+
+/* checks the store of a replica that isn't running. repairing talks to the peers, but nothing is published or served */
+func fsck(serverName string, pid int, mountpoint string, dbpath string, hostEndpoint util.Endpoint, keyfile string, transportName string, repair bool) int {
+	fsys.Init(serverName, pid, mountpoint, dbpath, hostEndpoint)
+	fsys.SetMyPid(pid)
+	if err := fsys.LoadState(); err != nil {
+		log.Fatal(err)
+	}
+	fsys.InitMembership()
+	if repair {
+		if keyfile != "" {
+			if err := fsys.LoadKeyFile(keyfile); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if err := fsys.InitTransport(transportName); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	report := fsys.Fsck(fsys.State.Root_version_bootstrap, repair)
+	fmt.Printf("checked %d versions and %d chunks from %s, %d problems\n", report.Nodes, report.Chunks, report.RootVid, len(report.Problems))
+	for _, p := range report.Problems {
+		fmt.Println(p)
+	}
+	storage.Close()
+	if !report.Clean() {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,284 @@
+package metrics
+
+import (
+	"io"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"strings"
+	"net/http"
+)
+
+/*
+======================
+METRICS
+=======================
+*/
+
+/*
+	Counters, gauges and histograms served over HTTP in the Prometheus text format, so any
+	Prometheus can scrape a replica. Metrics are created once (usually as package variables)
+	and labelled by value at the point of use; every distinct combination of label values is
+	its own series.
+*/
+
+/* seconds; from a cached lookup to a fetch from a slow peer */
+var DefaultBuckets = []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type metric interface {
+	write(w io.Writer)
+}
+
+var registry struct {
+	lock sync.Mutex
+	names []string
+	metrics map[string]metric
+}
+
+func register(name string, m metric) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	if registry.metrics == nil {
+		registry.metrics = make(map[string]metric)
+	}
+	if _, found := registry.metrics[name]; found {
+		panic("metrics: " + name + " registered twice")
+	}
+	registry.names = append(registry.names, name)
+	registry.metrics[name] = m
+}
+
+/* labels of one series, as name="value" pairs. values are escaped the way the text format wants */
+func labelString(names []string, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		v = strings.Replace(v, `\`, `\\`, -1)
+		v = strings.Replace(v, `"`, `\"`, -1)
+		v = strings.Replace(v, "\n", `\n`, -1)
+		pairs[i] = fmt.Sprintf(`%s="%s"`, name, v)
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+/* the series of a metric, sorted so scrapes are stable */
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+/* counters */
+
+type Counter struct {
+	name string
+	help string
+	labels []string
+	lock sync.Mutex
+	values map[string]float64
+	series map[string][]string
+}
+
+func NewCounter(name string, help string, labels ...string) *Counter {
+	c := &Counter{name: name, help: help, labels: labels, values: make(map[string]float64), series: make(map[string][]string)}
+	register(name, c)
+	return c
+}
+
+func (c *Counter) Add(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.values[key] += v
+	c.series[key] = labelValues
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.series) {
+		fmt.Fprintf(w, "%s%s %v\n", c.name, labelString(c.labels, c.series[key]), c.values[key])
+	}
+}
+
+/* gauges */
+
+type Gauge struct {
+	name string
+	help string
+	labels []string
+	lock sync.Mutex
+	values map[string]float64
+	series map[string][]string
+}
+
+func NewGauge(name string, help string, labels ...string) *Gauge {
+	g := &Gauge{name: name, help: help, labels: labels, values: make(map[string]float64), series: make(map[string][]string)}
+	register(name, g)
+	return g
+}
+
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	g.values[key] = v
+	g.series[key] = labelValues
+}
+
+func (g *Gauge) write(w io.Writer) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	for _, key := range sortedKeys(g.series) {
+		fmt.Fprintf(w, "%s%s %v\n", g.name, labelString(g.labels, g.series[key]), g.values[key])
+	}
+}
+
+/* a sample of a gauge computed when scraped */
+type Sample struct {
+	LabelValues []string
+	Value float64
+}
+
+type GaugeFunc struct {
+	name string
+	help string
+	labels []string
+	fn func() []Sample
+}
+
+/* fn is called on every scrape, from the HTTP server's goroutine */
+func NewGaugeFunc(name string, help string, fn func() []Sample, labels ...string) *GaugeFunc {
+	g := &GaugeFunc{name, help, labels, fn}
+	register(name, g)
+	return g
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	for _, s := range g.fn() {
+		fmt.Fprintf(w, "%s%s %v\n", g.name, labelString(g.labels, s.LabelValues), s.Value)
+	}
+}
+
+/* histograms */
+
+type histogramSeries struct {
+	labelValues []string
+	counts []uint64		/* per bucket, not cumulative */
+	count uint64
+	sum float64
+}
+
+type Histogram struct {
+	name string
+	help string
+	labels []string
+	buckets []float64
+	lock sync.Mutex
+	series map[string]*histogramSeries
+}
+
+/* buckets are upper bounds in increasing order, DefaultBuckets if nil */
+func NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	h := &Histogram{name: name, help: help, labels: labels, buckets: buckets, series: make(map[string]*histogramSeries)}
+	register(name, h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	s, found := h.series[key]
+	if !found {
+		s = &histogramSeries{labelValues, make([]uint64, len(h.buckets)), 0, 0}
+		h.series[key] = s
+	}
+	for i, le := range h.buckets {
+		if v <= le {
+			s.counts[i]++
+			break
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	bucketLabels := append(append([]string{}, h.labels...), "le")
+	for _, key := range keys {
+		s := h.series[key]
+		var cumulative uint64
+		for i, le := range h.buckets {
+			cumulative += s.counts[i]
+			values := append(append([]string{}, s.labelValues...), fmt.Sprintf("%v", le))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelString(bucketLabels, values), cumulative)
+		}
+		values := append(append([]string{}, s.labelValues...), "+Inf")
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, labelString(bucketLabels, values), s.count)
+		fmt.Fprintf(w, "%s_sum%s %v\n", h.name, labelString(h.labels, s.labelValues), s.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, labelString(h.labels, s.labelValues), s.count)
+	}
+}
+
+/* serving */
+
+/* writes every registered metric in the Prometheus text format */
+func WriteAll(w io.Writer) {
+	registry.lock.Lock()
+	names := append([]string{}, registry.names...)
+	metrics := make([]metric, len(names))
+	for i, name := range names {
+		metrics[i] = registry.metrics[name]
+	}
+	registry.lock.Unlock()
+
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+func handler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	WriteAll(w)
+}
+
+/* serves /metrics on addr until the returned listener is closed */
+func Serve(addr string) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", handler)
+	go http.Serve(l, mux)
+	return l, nil
+}
@@ -12,6 +12,11 @@ import (
 )
 
 import "github.com/syndtr/goleveldb/leveldb"
+import leveldbutil "github.com/syndtr/goleveldb/leveldb/util"
+import "github.com/syndtr/goleveldb/leveldb/opt"
+
+/* written with a synced write by Sync */
+const SYNC_KEY string = "SYNC"
 
 var db *leveldb.DB
 var path string
@@ -29,6 +34,30 @@ func Put(key []byte, val []byte) error {
 	return db.Put(key, val, nil)
 }
 
+func Delete(key []byte) error {
+	return db.Delete(key, nil)
+}
+
+/* waits until every write made so far is on disk. leveldb's journal is sequential, so one synced write is enough */
+func Sync() error {
+	return db.Put([]byte(SYNC_KEY), []byte{}, &opt.WriteOptions{Sync: true})
+}
+
+/* calls fn on every key/value pair whose key starts with prefix, in key order. stops early if fn returns false */
+func Iterate(prefix []byte, fn func(key []byte, val []byte) bool) error {
+	iter := db.NewIterator(leveldbutil.BytesPrefix(prefix), nil)
+	defer iter.Release()
+	for iter.Next() {
+		/* the iterator reuses its buffers, so hand out copies */
+		key := append([]byte{}, iter.Key()...)
+		val := append([]byte{}, iter.Value()...)
+		if !fn(key, val) {
+			break
+		}
+	}
+	return iter.Error()
+}
+
 func Clear() {
 	fmt.Println("clearing path: ", path)
 	Close()
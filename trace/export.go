@@ -0,0 +1,195 @@
+package trace
+
+import (
+	"os"
+	"fmt"
+	"sync"
+	"time"
+	"bytes"
+	"strings"
+	"net/http"
+	"encoding/json"
+)
+
+/*
+======================
+EXPORTERS
+=======================
+*/
+
+/* how often the OTLP exporter sends what it has buffered, and how much it buffers at most */
+const OTLP_FLUSH_SECONDS int = 5
+const OTLP_MAX_BUFFERED int = 10000
+
+/* opens the exporter described by spec: otlp://host:port sends to an OTLP/HTTP collector, anything else is a file */
+func NewExporter(spec string) (Exporter, error) {
+	if strings.HasPrefix(spec, "otlp://") {
+		return NewOTLPExporter("http://" + strings.TrimPrefix(spec, "otlp://") + "/v1/traces"), nil
+	}
+	return NewFileExporter(spec)
+}
+
+/* file: one JSON SpanData per line */
+
+type fileExporter struct {
+	lock sync.Mutex
+	f *os.File
+	enc *json.Encoder
+}
+
+/* appends spans to the file at path */
+func NewFileExporter(path string) (Exporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &fileExporter{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+func (e *fileExporter) Export(s SpanData) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.enc.Encode(s)
+}
+
+func (e *fileExporter) Close() error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	return e.f.Close()
+}
+
+/* OTLP: batches of spans POSTed as OTLP/JSON to a collector, e.g. http://localhost:4318/v1/traces */
+
+type otlpExporter struct {
+	url string
+	lock sync.Mutex
+	buffered []SpanData
+	quit chan bool
+	done chan bool
+}
+
+func NewOTLPExporter(url string) Exporter {
+	e := &otlpExporter{url: url, quit: make(chan bool), done: make(chan bool)}
+	go func() {
+		for {
+			select {
+				case <-e.quit:
+					e.send()
+					close(e.done)
+					return
+				case <-time.After(time.Duration(OTLP_FLUSH_SECONDS) * time.Second):
+					e.send()
+			}
+		}
+	}()
+	return e
+}
+
+func (e *otlpExporter) Export(s SpanData) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	/* if the collector is gone, drop the oldest rather than grow forever */
+	if len(e.buffered) >= OTLP_MAX_BUFFERED {
+		e.buffered = e.buffered[1:]
+	}
+	e.buffered = append(e.buffered, s)
+}
+
+func (e *otlpExporter) Close() error {
+	close(e.quit)
+	<-e.done
+	return nil
+}
+
+func (e *otlpExporter) send() {
+	e.lock.Lock()
+	batch := e.buffered
+	e.buffered = nil
+	e.lock.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+
+	body, _ := json.Marshal(otlpRequest(batch))
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "trace: dropped %d spans: %v\n", len(batch), err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode / 100 != 2 {
+		fmt.Fprintf(os.Stderr, "trace: dropped %d spans: collector said %s\n", len(batch), resp.Status)
+	}
+}
+
+/* the OTLP/JSON encoding of an ExportTraceServiceRequest. ids are hex, times are nanoseconds as strings */
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttr struct {
+	Key string `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code int `json:"code"`		/* 0 unset, 2 error */
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID string `json:"traceId"`
+	SpanID string `json:"spanId"`
+	ParentSpanID string `json:"parentSpanId,omitempty"`
+	Name string `json:"name"`
+	Kind int `json:"kind"`
+	StartTimeUnixNano string `json:"startTimeUnixNano"`
+	EndTimeUnixNano string `json:"endTimeUnixNano"`
+	Attributes []otlpAttr `json:"attributes,omitempty"`
+	Status otlpStatus `json:"status"`
+}
+
+func otlpAttrs(attrs []Attr) []otlpAttr {
+	out := []otlpAttr{}
+	for _, a := range attrs {
+		out = append(out, otlpAttr{a.Key, otlpValue{a.Value}})
+	}
+	return out
+}
+
+func otlpRequest(batch []SpanData) map[string]interface{} {
+	spans := []otlpSpan{}
+	for _, s := range batch {
+		o := otlpSpan{
+			TraceID: s.TraceID,
+			SpanID: s.SpanID,
+			ParentSpanID: s.ParentID,
+			Name: s.Name,
+			Kind: 1,	/* internal */
+			StartTimeUnixNano: fmt.Sprintf("%d", s.Start.UnixNano()),
+			EndTimeUnixNano: fmt.Sprintf("%d", s.End.UnixNano()),
+			Attributes: otlpAttrs(s.Attrs),
+		}
+		if s.Error != "" {
+			o.Status = otlpStatus{2, s.Error}
+		}
+		spans = append(spans, o)
+	}
+	return map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpAttrs([]Attr{{"service.name", Service}}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "p4/trace"},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,164 @@
+package trace
+
+import (
+	"sync"
+	"time"
+	"crypto/rand"
+	"encoding/hex"
+)
+
+/*
+======================
+TRACING
+=======================
+*/
+
+/*
+	Spans in the OpenTelemetry model: every span belongs to a trace, has a parent unless it
+	starts one, and is exported when it ends. A SpanContext is all that has to travel for a
+	span on another replica to join the trace, so messages carry one. Nothing is recorded
+	until an exporter is set; until then Start returns nil, and every method of a nil *Span
+	does nothing.
+*/
+
+type SpanContext struct {
+	TraceID string	/* 16 bytes, hex */
+	SpanID string	/* 8 bytes, hex */
+}
+
+/* no parent: a span started from it starts a new trace */
+var None SpanContext
+
+func (c SpanContext) Valid() bool {
+	return c.TraceID != "" && c.SpanID != ""
+}
+
+type Attr struct {
+	Key string
+	Value string
+}
+
+/* an ended span, as exporters get it */
+type SpanData struct {
+	Name string
+	TraceID string
+	SpanID string
+	ParentID string
+	Start time.Time
+	End time.Time
+	Attrs []Attr
+	Error string
+}
+
+type Span struct {
+	lock sync.Mutex
+	data SpanData
+	ended bool
+}
+
+type Exporter interface {
+	Export(s SpanData)
+	/* exports whatever is buffered and releases the exporter */
+	Close() error
+}
+
+var exporter struct {
+	lock sync.Mutex
+	e Exporter
+}
+
+/* the service spans are recorded for, e.g. the replica's name */
+var Service = "gofs"
+
+/* starts exporting spans to e, or stops recording them if e is nil. the previous exporter is closed */
+func SetExporter(e Exporter) {
+	exporter.lock.Lock()
+	defer exporter.lock.Unlock()
+	if exporter.e != nil {
+		exporter.e.Close()
+	}
+	exporter.e = e
+}
+
+func Enabled() bool {
+	exporter.lock.Lock()
+	defer exporter.lock.Unlock()
+	return exporter.e != nil
+}
+
+func newID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+/* starts a span, a child of parent if it is Valid. attrs are key, value pairs */
+func Start(parent SpanContext, name string, attrs ...string) *Span {
+	if !Enabled() {
+		return nil
+	}
+	s := &Span{}
+	s.data.Name = name
+	s.data.Start = time.Now()
+	s.data.SpanID = newID(8)
+	if parent.Valid() {
+		s.data.TraceID = parent.TraceID
+		s.data.ParentID = parent.SpanID
+	} else {
+		s.data.TraceID = newID(16)
+	}
+	for i := 0; i + 1 < len(attrs); i += 2 {
+		s.data.Attrs = append(s.data.Attrs, Attr{attrs[i], attrs[i + 1]})
+	}
+	return s
+}
+
+/* what to hand to children of s, None if s is nil */
+func (s *Span) Context() SpanContext {
+	if s == nil {
+		return None
+	}
+	return SpanContext{s.data.TraceID, s.data.SpanID}
+}
+
+func (s *Span) SetAttr(key string, value string) {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.data.Attrs = append(s.data.Attrs, Attr{key, value})
+}
+
+/* marks the span as failed, if err isn't nil */
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.data.Error = err.Error()
+}
+
+/* ends the span and hands it to the exporter. ending it again does nothing */
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.lock.Lock()
+	if s.ended {
+		s.lock.Unlock()
+		return
+	}
+	s.ended = true
+	s.data.End = time.Now()
+	data := s.data
+	s.lock.Unlock()
+
+	exporter.lock.Lock()
+	e := exporter.e
+	exporter.lock.Unlock()
+	if e != nil {
+		e.Export(data)
+	}
+}
@@ -0,0 +1,259 @@
+package transport
+
+import (
+	"sync"
+	"time"
+	"errors"
+)
+
+/*
+=======================
+IN-PROCESS TRANSPORT
+=======================
+*/
+
+/*
+	Connects endpoints living in the same process through channels, with the same semantics as
+	the network transports: subscribers may connect before anyone publishes, slow subscribers
+	lose messages, and requests to an address nobody serves time out. Every transport created
+	with New("inproc", ...) shares one address space, so several replicas' endpoints can run
+	side by side in one binary, e.g. a single go test.
+*/
+
+var ErrAddressInUse = errors.New("transport: address in use")
+
+/* the address space shared by every inproc transport */
+var hub struct {
+	lock sync.Mutex
+	publishers map[string]*inprocPublisher
+	responders map[string]*inprocResponder
+	/* subscribers connected to each address, whether or not anybody publishes there yet */
+	subscribers map[string]map[*inprocSubscriber]bool
+}
+
+func init() {
+	hub.publishers = make(map[string]*inprocPublisher)
+	hub.responders = make(map[string]*inprocResponder)
+	hub.subscribers = make(map[string]map[*inprocSubscriber]bool)
+
+	Register("inproc", func(sec Security) (Transport, error) {
+		if sec.Enabled() {
+			return nil, ErrNoAuth
+		}
+		return &inprocTransport{}, nil
+	})
+}
+
+type inprocTransport struct{}
+
+func (t *inprocTransport) Allow(key string, allowed bool) {}
+
+func (t *inprocTransport) Close() error {
+	return nil
+}
+
+/* publish */
+
+type inprocPublisher struct {
+	addr string
+}
+
+func (t *inprocTransport) Publish(addr string) (Publisher, error) {
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+	if _, found := hub.publishers[addr]; found {
+		return nil, ErrAddressInUse
+	}
+	p := &inprocPublisher{addr}
+	hub.publishers[addr] = p
+	return p, nil
+}
+
+func (p *inprocPublisher) Send(data []byte) error {
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+	if hub.publishers[p.addr] != p {
+		return ErrClosed
+	}
+	for s := range hub.subscribers[p.addr] {
+		s.lock.Lock()
+		wanted := matches(data, s.prefixes)
+		s.lock.Unlock()
+		if wanted {
+			/* hand out a copy, the publisher may reuse its buffer */
+			select {
+				case s.incoming <- received{append([]byte{}, data...), p.addr}:
+				default:
+			}
+		}
+	}
+	return nil
+}
+
+func (p *inprocPublisher) Close() error {
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+	if hub.publishers[p.addr] == p {
+		delete(hub.publishers, p.addr)
+	}
+	return nil
+}
+
+/* subscribe */
+
+type inprocSubscriber struct {
+	incoming chan received
+	closed chan bool
+	closeOnce sync.Once
+	lock sync.Mutex
+	prefixes map[string]bool
+	addrs map[string]bool
+}
+
+func (t *inprocTransport) NewSubscriber() (Subscriber, error) {
+	s := &inprocSubscriber{
+		incoming: make(chan received, SEND_QUEUE),
+		closed: make(chan bool),
+		prefixes: make(map[string]bool),
+		addrs: make(map[string]bool),
+	}
+	return s, nil
+}
+
+func (s *inprocSubscriber) Connect(addr string) error {
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+	if hub.subscribers[addr] == nil {
+		hub.subscribers[addr] = make(map[*inprocSubscriber]bool)
+	}
+	hub.subscribers[addr][s] = true
+	s.addrs[addr] = true
+	return nil
+}
+
+func (s *inprocSubscriber) Disconnect(addr string) error {
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+	delete(hub.subscribers[addr], s)
+	delete(s.addrs, addr)
+	return nil
+}
+
+func (s *inprocSubscriber) Subscribe(prefix []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.prefixes[string(prefix)] = true
+	return nil
+}
+
+func (s *inprocSubscriber) Unsubscribe(prefix []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.prefixes, string(prefix))
+	return nil
+}
+
+func (s *inprocSubscriber) Recv(timeout time.Duration) ([]byte, string, error) {
+	select {
+		case r := <-s.incoming:
+			return r.data, r.addr, nil
+		case <-s.closed:
+			return nil, "", ErrClosed
+		case <-time.After(timeout):
+			return nil, "", ErrTimeout
+	}
+}
+
+func (s *inprocSubscriber) Close() error {
+	hub.lock.Lock()
+	for addr := range s.addrs {
+		delete(hub.subscribers[addr], s)
+	}
+	hub.lock.Unlock()
+	s.closeOnce.Do(func() { close(s.closed) })
+	return nil
+}
+
+/* reply */
+
+type inprocRequest struct {
+	data []byte
+	reply chan []byte
+}
+
+type inprocResponder struct {
+	addr string
+	requests chan inprocRequest
+	closed chan bool
+	current chan []byte
+}
+
+func (t *inprocTransport) Respond(addr string) (Responder, error) {
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+	if _, found := hub.responders[addr]; found {
+		return nil, ErrAddressInUse
+	}
+	r := &inprocResponder{addr: addr, requests: make(chan inprocRequest), closed: make(chan bool)}
+	hub.responders[addr] = r
+	return r, nil
+}
+
+func (r *inprocResponder) Recv() ([]byte, string, error) {
+	select {
+		case req := <-r.requests:
+			r.current = req.reply
+			return req.data, "", nil
+		case <-r.closed:
+			return nil, "", ErrClosed
+	}
+}
+
+func (r *inprocResponder) Reply(data []byte) error {
+	if r.current == nil {
+		return ErrClosed
+	}
+	/* buffered, so a requester that gave up doesn't block us */
+	r.current <- append([]byte{}, data...)
+	r.current = nil
+	return nil
+}
+
+func (r *inprocResponder) Close() error {
+	hub.lock.Lock()
+	defer hub.lock.Unlock()
+	if hub.responders[r.addr] == r {
+		delete(hub.responders, r.addr)
+		close(r.closed)
+	}
+	return nil
+}
+
+/* request */
+func (t *inprocTransport) Request(addr string, data []byte, timeout time.Duration) ([]byte, error) {
+	deadline := time.After(timeout)
+	req := inprocRequest{append([]byte{}, data...), make(chan []byte, 1)}
+
+	hub.lock.Lock()
+	r, found := hub.responders[addr]
+	hub.lock.Unlock()
+	if !found {
+		/* like a dead peer, nobody answers */
+		<-deadline
+		return nil, ErrTimeout
+	}
+
+	select {
+		case r.requests <- req:
+		case <-r.closed:
+			return nil, ErrClosed
+		case <-deadline:
+			return nil, ErrTimeout
+	}
+	select {
+		case reply := <-req.reply:
+			return reply, nil
+		case <-deadline:
+			return nil, ErrTimeout
+	}
+}
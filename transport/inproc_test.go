@@ -0,0 +1,94 @@
+package transport
+
+import (
+	"time"
+	"testing"
+)
+
+func newInproc(t *testing.T) Transport {
+	tr, err := New("inproc", Security{})
+	if err != nil {
+		t.Fatalf("inproc: %v", err)
+	}
+	return tr
+}
+
+/* two endpoints, each publishing to the other and asking the other */
+func TestInprocTwoEndpoints(t *testing.T) {
+	one, two := newInproc(t), newInproc(t)
+
+	sub, _ := two.NewSubscriber()
+	defer sub.Close()
+	/* connecting before anyone publishes there is fine */
+	sub.Connect("one:1")
+	sub.Subscribe([]byte("/a/"))
+	pub, err := one.Publish("one:1")
+	if err != nil {
+		t.Fatalf("publish: %v", err)
+	}
+	defer pub.Close()
+	if _, err = two.Publish("one:1"); err != ErrAddressInUse {
+		t.Errorf("second publisher at one:1: %v, want ErrAddressInUse", err)
+	}
+
+	pub.Send([]byte("/b/skipped"))
+	pub.Send([]byte("/a/wanted"))
+	data, addr, err := sub.Recv(time.Second)
+	if err != nil || string(data) != "/a/wanted" || addr != "one:1" {
+		t.Errorf("received %q from %q (%v), want /a/wanted from one:1", data, addr, err)
+	}
+	if data, _, err = sub.Recv(10 * time.Millisecond); err != ErrTimeout {
+		t.Errorf("received %q (%v), want a timeout", data, err)
+	}
+
+	rep, err := two.Respond("two:2")
+	if err != nil {
+		t.Fatalf("respond: %v", err)
+	}
+	go func() {
+		for {
+			req, _, err := rep.Recv()
+			if err != nil {
+				return
+			}
+			rep.Reply(append([]byte("re: "), req...))
+		}
+	}()
+	reply, err := one.Request("two:2", []byte("hello"), time.Second)
+	if err != nil || string(reply) != "re: hello" {
+		t.Errorf("reply %q (%v), want re: hello", reply, err)
+	}
+	rep.Close()
+
+	/* nobody serves there any more, like a dead peer */
+	if _, err = one.Request("two:2", []byte("hello"), 10 * time.Millisecond); err != ErrTimeout {
+		t.Errorf("request to a closed responder: %v, want ErrTimeout", err)
+	}
+}
+
+func TestInprocDisconnectAndClose(t *testing.T) {
+	tr := newInproc(t)
+	pub, _ := tr.Publish("three:1")
+	defer pub.Close()
+	sub, _ := tr.NewSubscriber()
+	sub.Connect("three:1")
+	sub.Subscribe([]byte{})
+
+	sub.Disconnect("three:1")
+	pub.Send([]byte("after disconnect"))
+	if data, _, err := sub.Recv(10 * time.Millisecond); err != ErrTimeout {
+		t.Errorf("received %q (%v) after disconnecting", data, err)
+	}
+	sub.Close()
+	if _, _, err := sub.Recv(time.Second); err != ErrClosed {
+		t.Errorf("recv on a closed subscriber: %v, want ErrClosed", err)
+	}
+	/* closing again does nothing */
+	sub.Close()
+}
+
+func TestInprocRefusesAuthentication(t *testing.T) {
+	if _, err := New("inproc", Security{PublicKey: "pub", SecretKey: "secret"}); err != ErrNoAuth {
+		t.Errorf("inproc with keys: %v, want ErrNoAuth", err)
+	}
+}
@@ -0,0 +1,78 @@
+package transport
+
+import (
+	"errors"
+	"crypto/ecdh"
+	"crypto/rand"
+)
+
+/*
+=======================
+CURVE KEYS
+=======================
+*/
+
+/* keys are curve25519 keys in Z85 text form, the way CurveZMQ expects them */
+
+const z85Alphabet string = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ.-:+=^!/*?&<>()[]{}@%$#"
+
+func z85Encode(data []byte) string {
+	out := make([]byte, 0, len(data) * 5 / 4)
+	for i := 0; i + 4 <= len(data); i += 4 {
+		value := uint32(data[i]) << 24 | uint32(data[i + 1]) << 16 | uint32(data[i + 2]) << 8 | uint32(data[i + 3])
+		chunk := make([]byte, 5)
+		for j := 4; j >= 0; j-- {
+			chunk[j] = z85Alphabet[value % 85]
+			value /= 85
+		}
+		out = append(out, chunk...)
+	}
+	return string(out)
+}
+
+func z85Decode(s string) ([]byte, error) {
+	if len(s) % 5 != 0 {
+		return nil, errors.New("z85: bad length")
+	}
+	out := make([]byte, 0, len(s) * 4 / 5)
+	for i := 0; i < len(s); i += 5 {
+		var value uint32
+		for j := 0; j < 5; j++ {
+			digit := -1
+			for k := 0; k < len(z85Alphabet); k++ {
+				if z85Alphabet[k] == s[i + j] {
+					digit = k
+					break
+				}
+			}
+			if digit < 0 {
+				return nil, errors.New("z85: bad character")
+			}
+			value = value * 85 + uint32(digit)
+		}
+		out = append(out, byte(value >> 24), byte(value >> 16), byte(value >> 8), byte(value))
+	}
+	return out, nil
+}
+
+/* generates a new key pair */
+func GenerateKeyPair() (public string, secret string, err error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	return z85Encode(key.PublicKey().Bytes()), z85Encode(key.Bytes()), nil
+}
+
+/* derives the public key belonging to a secret key */
+func PublicKeyFor(secret string) (string, error) {
+	raw, err := z85Decode(secret)
+	if err != nil {
+		return "", err
+	}
+	key, err := ecdh.X25519().NewPrivateKey(raw)
+	if err != nil {
+		return "", err
+	}
+	return z85Encode(key.PublicKey().Bytes()), nil
+}
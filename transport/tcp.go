@@ -0,0 +1,401 @@
+package transport
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+	"encoding/binary"
+)
+
+/*
+=======================
+TCP TRANSPORT
+=======================
+*/
+
+/*
+	Pure Go, no cgo. Every message is a frame: a 4 byte big-endian length followed by the
+	payload. Subscribers tell publishers what they subscribe to with control frames (first byte
+	1 = subscribe, 0 = unsubscribe, then the prefix), so filtering happens at the publisher like
+	it does with zmq. Like zmq PUB with DONTWAIT, a subscriber that can't keep up loses messages.
+	Requests use one connection each.
+*/
+
+/* largest frame accepted, to keep a confused peer from making us allocate gigabytes */
+const MAX_FRAME int = 256 << 20
+
+/* messages buffered per subscriber before they are dropped */
+const SEND_QUEUE int = 1024
+
+/* how long a subscriber waits between attempts to reach a publisher */
+const RECONNECT_INTERVAL = time.Second
+
+type tcpTransport struct{}
+
+func init() {
+	Register("tcp", func(sec Security) (Transport, error) {
+		if sec.Enabled() {
+			return nil, ErrNoAuth
+		}
+		return &tcpTransport{}, nil
+	})
+}
+
+func (t *tcpTransport) Allow(key string, allowed bool) {}
+
+func (t *tcpTransport) Close() error {
+	return nil
+}
+
+func writeFrame(w io.Writer, data []byte) error {
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(len(data)))
+	if _, err := w.Write(append(header, data...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func readFrame(r io.Reader) ([]byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	length := int(binary.BigEndian.Uint32(header))
+	if length > MAX_FRAME {
+		return nil, io.ErrUnexpectedEOF
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+/* publish */
+
+type tcpPublisher struct {
+	listener net.Listener
+	lock sync.Mutex
+	subscribers map[*tcpSubscription]bool
+}
+
+/* one connected subscriber, as seen from the publisher */
+type tcpSubscription struct {
+	conn net.Conn
+	queue chan []byte
+	lock sync.Mutex
+	prefixes map[string]bool
+}
+
+func (t *tcpTransport) Publish(addr string) (Publisher, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	p := &tcpPublisher{listener: listener, subscribers: make(map[*tcpSubscription]bool)}
+	go p.accept()
+	return p, nil
+}
+
+func (p *tcpPublisher) accept() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		s := &tcpSubscription{conn: conn, queue: make(chan []byte, SEND_QUEUE), prefixes: make(map[string]bool)}
+		p.lock.Lock()
+		p.subscribers[s] = true
+		p.lock.Unlock()
+
+		/* writer */
+		go func() {
+			for data := range s.queue {
+				if writeFrame(s.conn, data) != nil {
+					s.conn.Close()
+				}
+			}
+		}()
+		/* reader of subscription changes */
+		go func() {
+			for {
+				control, err := readFrame(s.conn)
+				if err != nil || len(control) == 0 {
+					break
+				}
+				s.lock.Lock()
+				if control[0] == 1 {
+					s.prefixes[string(control[1:])] = true
+				} else {
+					delete(s.prefixes, string(control[1:]))
+				}
+				s.lock.Unlock()
+			}
+			p.lock.Lock()
+			delete(p.subscribers, s)
+			p.lock.Unlock()
+			s.conn.Close()
+			close(s.queue)
+		}()
+	}
+}
+
+func (p *tcpPublisher) Send(data []byte) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for s := range p.subscribers {
+		s.lock.Lock()
+		wanted := matches(data, s.prefixes)
+		s.lock.Unlock()
+		if wanted {
+			select {
+				case s.queue <- data:
+				default:
+					/* subscriber is too slow, drop */
+			}
+		}
+	}
+	return nil
+}
+
+func (p *tcpPublisher) Close() error {
+	err := p.listener.Close()
+	p.lock.Lock()
+	for s := range p.subscribers {
+		s.conn.Close()
+	}
+	p.lock.Unlock()
+	return err
+}
+
+/* subscribe */
+
+type tcpSubscriber struct {
+	incoming chan received
+	closed chan bool
+	closeOnce sync.Once
+
+	lock sync.Mutex
+	prefixes map[string]bool
+	/* per address: closed to stop the dialer, and the live connection if any */
+	stops map[string]chan bool
+	conns map[string]net.Conn
+}
+
+func (t *tcpTransport) NewSubscriber() (Subscriber, error) {
+	s := &tcpSubscriber{
+		incoming: make(chan received, SEND_QUEUE),
+		closed: make(chan bool),
+		prefixes: make(map[string]bool),
+		stops: make(map[string]chan bool),
+		conns: make(map[string]net.Conn),
+	}
+	return s, nil
+}
+
+func (s *tcpSubscriber) Connect(addr string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, found := s.stops[addr]; found {
+		return nil
+	}
+	stop := make(chan bool)
+	s.stops[addr] = stop
+	go s.dial(addr, stop)
+	return nil
+}
+
+/* keeps a connection to addr open until stop is closed */
+func (s *tcpSubscriber) dial(addr string, stop chan bool) {
+	for {
+		conn, err := net.DialTimeout("tcp", addr, RECONNECT_INTERVAL)
+		if err == nil {
+			s.lock.Lock()
+			select {
+				case <-stop:
+					s.lock.Unlock()
+					conn.Close()
+					return
+				default:
+			}
+			s.conns[addr] = conn
+			for prefix := range s.prefixes {
+				writeFrame(conn, append([]byte{1}, prefix...))
+			}
+			s.lock.Unlock()
+
+			for {
+				data, rerr := readFrame(conn)
+				if rerr != nil {
+					break
+				}
+				select {
+					case s.incoming <- received{data, addr}:
+					case <-stop:
+				}
+			}
+			conn.Close()
+			s.lock.Lock()
+			if s.conns[addr] == conn {
+				delete(s.conns, addr)
+			}
+			s.lock.Unlock()
+		}
+		select {
+			case <-stop:
+				return
+			case <-time.After(RECONNECT_INTERVAL):
+		}
+	}
+}
+
+func (s *tcpSubscriber) Disconnect(addr string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if stop, found := s.stops[addr]; found {
+		close(stop)
+		delete(s.stops, addr)
+	}
+	if conn, found := s.conns[addr]; found {
+		conn.Close()
+		delete(s.conns, addr)
+	}
+	return nil
+}
+
+/* tells every connected publisher about a subscription change */
+func (s *tcpSubscriber) control(flag byte, prefix []byte) {
+	for _, conn := range s.conns {
+		writeFrame(conn, append([]byte{flag}, prefix...))
+	}
+}
+
+func (s *tcpSubscriber) Subscribe(prefix []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.prefixes[string(prefix)] = true
+	s.control(1, prefix)
+	return nil
+}
+
+func (s *tcpSubscriber) Unsubscribe(prefix []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.prefixes, string(prefix))
+	s.control(0, prefix)
+	return nil
+}
+
+func (s *tcpSubscriber) Recv(timeout time.Duration) ([]byte, string, error) {
+	select {
+		case r := <-s.incoming:
+			return r.data, r.addr, nil
+		case <-s.closed:
+			return nil, "", ErrClosed
+		case <-time.After(timeout):
+			return nil, "", ErrTimeout
+	}
+}
+
+func (s *tcpSubscriber) Close() error {
+	s.lock.Lock()
+	addrs := []string{}
+	for addr := range s.stops {
+		addrs = append(addrs, addr)
+	}
+	s.lock.Unlock()
+	for _, addr := range addrs {
+		s.Disconnect(addr)
+	}
+	s.closeOnce.Do(func() { close(s.closed) })
+	return nil
+}
+
+/* reply */
+
+type tcpRequest struct {
+	data []byte
+	conn net.Conn
+}
+
+type tcpResponder struct {
+	listener net.Listener
+	requests chan tcpRequest
+	closed chan bool
+	current net.Conn
+}
+
+func (t *tcpTransport) Respond(addr string) (Responder, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	r := &tcpResponder{listener: listener, requests: make(chan tcpRequest), closed: make(chan bool)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				close(r.closed)
+				return
+			}
+			go func() {
+				data, err := readFrame(conn)
+				if err != nil {
+					conn.Close()
+					return
+				}
+				select {
+					case r.requests <- tcpRequest{data, conn}:
+					case <-r.closed:
+						conn.Close()
+				}
+			}()
+		}
+	}()
+	return r, nil
+}
+
+func (r *tcpResponder) Recv() ([]byte, string, error) {
+	select {
+		case req := <-r.requests:
+			r.current = req.conn
+			return req.data, "", nil
+		case <-r.closed:
+			return nil, "", ErrClosed
+	}
+}
+
+func (r *tcpResponder) Reply(data []byte) error {
+	if r.current == nil {
+		return ErrClosed
+	}
+	err := writeFrame(r.current, data)
+	r.current.Close()
+	r.current = nil
+	return err
+}
+
+func (r *tcpResponder) Close() error {
+	return r.listener.Close()
+}
+
+/* request */
+func (t *tcpTransport) Request(addr string, data []byte, timeout time.Duration) ([]byte, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if err = writeFrame(conn, data); err != nil {
+		return nil, err
+	}
+	reply, err := readFrame(conn)
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		return nil, ErrTimeout
+	}
+	return reply, err
+}
@@ -0,0 +1,21 @@
+package transport
+
+import (
+	"time"
+	"testing"
+)
+
+func TestTcpSubscriberCloseTwice(t *testing.T) {
+	tr, err := New("tcp", Security{})
+	if err != nil {
+		t.Fatalf("tcp: %v", err)
+	}
+	sub, _ := tr.NewSubscriber()
+	/* nobody listens there, the dialer just keeps trying */
+	sub.Connect("127.0.0.1:1")
+	sub.Close()
+	sub.Close()
+	if _, _, err := sub.Recv(time.Second); err != ErrClosed {
+		t.Errorf("recv on a closed subscriber: %v, want ErrClosed", err)
+	}
+}
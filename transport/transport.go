@@ -0,0 +1,129 @@
+package transport
+
+import (
+	"time"
+	"sort"
+	"errors"
+)
+
+/*
+=======================
+TRANSPORT
+=======================
+*/
+
+/*
+	The messaging patterns replicas use to talk to each other: PUB/SUB for broadcasts and
+	REQ/REP for fetching. Addresses are plain host:port strings; each transport turns them
+	into whatever it needs. Implementations register themselves by name in init().
+*/
+
+var ErrTimeout = errors.New("transport: timed out")
+var ErrClosed = errors.New("transport: closed")
+var ErrNoAuth = errors.New("transport: authentication is not supported by this transport")
+
+/* sends every message to all connected subscribers whose subscriptions match it */
+type Publisher interface {
+	Send(data []byte) error
+	Close() error
+}
+
+/* receives from any number of publishers. not safe for concurrent use */
+type Subscriber interface {
+	/* connecting succeeds even if nobody listens at addr yet; the connection is retried in the background */
+	Connect(addr string) error
+	Disconnect(addr string) error
+	/* only messages starting with one of the subscribed prefixes are delivered. an empty prefix matches all */
+	Subscribe(prefix []byte) error
+	Unsubscribe(prefix []byte) error
+	/*
+		waits up to timeout for the next message, returning ErrTimeout if nothing arrives. addr is
+		the address (as given to Connect) of the publisher it came from; when authenticating, the
+		publisher there proved it holds Security.ServerKey(addr)
+	*/
+	Recv(timeout time.Duration) (data []byte, addr string, err error)
+	Close() error
+}
+
+/* serves requests one at a time: every Recv must be followed by a Reply */
+type Responder interface {
+	/* returns the next request and the public key the sender authenticated with ("" without authentication) */
+	Recv() (data []byte, identity string, err error)
+	Reply(data []byte) error
+	Close() error
+}
+
+type Transport interface {
+	Publish(addr string) (Publisher, error)
+	NewSubscriber() (Subscriber, error)
+	Respond(addr string) (Responder, error)
+	/* sends one request to the responder at addr and waits up to timeout for its reply */
+	Request(addr string, data []byte, timeout time.Duration) ([]byte, error)
+	/* lets clients holding `key` in, or shuts them out again. only meaningful when authenticating */
+	Allow(key string, allowed bool)
+	Close() error
+}
+
+/* key material for authenticated transports. a zero Security means no authentication */
+type Security struct {
+	PublicKey string
+	SecretKey string
+	/* public key of whoever serves at addr */
+	ServerKey func(addr string) string
+}
+
+func (s Security) Enabled() bool {
+	return s.SecretKey != ""
+}
+
+type constructor func(sec Security) (Transport, error)
+
+var registry map[string]constructor
+
+func Register(name string, c constructor) {
+	if registry == nil {
+		registry = make(map[string]constructor)
+	}
+	registry[name] = c
+}
+
+func New(name string, sec Security) (Transport, error) {
+	c, found := registry[name]
+	if !found {
+		return nil, errors.New("transport: unknown transport " + name)
+	}
+	return c(sec)
+}
+
+/* names of all transports compiled in */
+func Names() []string {
+	names := []string{}
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+/* zmq when built with cgo support for it, the pure Go tcp transport otherwise */
+func Default() string {
+	if _, found := registry["zmq"]; found {
+		return "zmq"
+	}
+	return "tcp"
+}
+
+/* a message and the address of the publisher it came from, as queued by subscribers */
+type received struct {
+	data []byte
+	addr string
+}
+
+func matches(data []byte, prefixes map[string]bool) bool {
+	for prefix := range prefixes {
+		if len(data) >= len(prefix) && string(data[:len(prefix)]) == prefix {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,300 @@
+//go:build !nozmq
+
+package transport
+
+import (
+	"time"
+	"syscall"
+	"github.com/pebbe/zmq4"
+)
+
+/*
+=======================
+ZEROMQ TRANSPORT
+=======================
+*/
+
+/*
+	Uses libzmq through cgo; build with -tags nozmq to leave it out. With key material every
+	socket uses CurveZMQ: bound sockets act as curve servers that only let in allowed keys,
+	connecting sockets verify the server against Security.ServerKey. A subscriber has a socket
+	per publisher, so it knows which (verified) publisher every message came from.
+*/
+
+const ZAP_DOMAIN string = "gofs"
+
+/* metadata property the ZAP handler attaches to every authenticated message */
+const pubkeyProperty string = "Pubkey"
+
+type zmqTransport struct {
+	sec Security
+}
+
+func init() {
+	Register("zmq", newZmqTransport)
+}
+
+func newZmqTransport(sec Security) (Transport, error) {
+	t := &zmqTransport{sec}
+	if sec.Enabled() {
+		if err := zmq4.AuthStart(); err != nil {
+			return nil, err
+		}
+		zmq4.AuthSetMetadataHandler(func(version, requestId, domain, address, identity, mechanism string, credentials ...string) map[string]string {
+			key := ""
+			if len(credentials) > 0 {
+				key = credentials[0]
+				/* raw 32 byte keys are handed over as is */
+				if len(key) == 32 {
+					key = zmq4.Z85encode(key)
+				}
+			}
+			return map[string]string{pubkeyProperty: key}
+		})
+	}
+	return t, nil
+}
+
+/* makes a socket about to be bound a curve server */
+func (t *zmqTransport) server(sock *zmq4.Socket) error {
+	if !t.sec.Enabled() {
+		return nil
+	}
+	sock.SetZapDomain(ZAP_DOMAIN)
+	sock.SetCurveServer(1)
+	return sock.SetCurveSecretkey(t.sec.SecretKey)
+}
+
+/* prepares a socket to connect to the curve server at addr. must be called before each Connect */
+func (t *zmqTransport) client(sock *zmq4.Socket, addr string) error {
+	if !t.sec.Enabled() {
+		return nil
+	}
+	serverKey := t.sec.ServerKey(addr)
+	if serverKey == "" {
+		return ErrNoAuth
+	}
+	sock.SetCurvePublickey(t.sec.PublicKey)
+	sock.SetCurveSecretkey(t.sec.SecretKey)
+	return sock.SetCurveServerkey(serverKey)
+}
+
+func (t *zmqTransport) Allow(key string, allowed bool) {
+	if !t.sec.Enabled() || key == "" {
+		return
+	}
+	if allowed {
+		zmq4.AuthCurveAdd(ZAP_DOMAIN, key)
+	} else {
+		zmq4.AuthCurveRemove(ZAP_DOMAIN, key)
+	}
+}
+
+func (t *zmqTransport) Close() error {
+	if t.sec.Enabled() {
+		zmq4.AuthStop()
+	}
+	return nil
+}
+
+func isTimeout(err error) bool {
+	return zmq4.AsErrno(err) == zmq4.Errno(syscall.EAGAIN)
+}
+
+/* publish */
+
+type zmqPublisher struct {
+	sock *zmq4.Socket
+}
+
+func (t *zmqTransport) Publish(addr string) (Publisher, error) {
+	sock, err := zmq4.NewSocket(zmq4.PUB)
+	if err != nil {
+		return nil, err
+	}
+	if err = t.server(sock); err != nil {
+		return nil, err
+	}
+	if err = sock.Bind("tcp://" + addr); err != nil {
+		return nil, err
+	}
+	return &zmqPublisher{sock}, nil
+}
+
+func (p *zmqPublisher) Send(data []byte) error {
+	_, err := p.sock.SendBytes(data, zmq4.DONTWAIT)
+	return err
+}
+
+func (p *zmqPublisher) Close() error {
+	return p.sock.Close()
+}
+
+/* subscribe */
+
+type zmqSubscriber struct {
+	t *zmqTransport
+	poller *zmq4.Poller
+	socks map[string]*zmq4.Socket
+	addrs map[*zmq4.Socket]string
+	prefixes map[string]bool
+	/* which of the ready sockets to read next, so a busy publisher doesn't starve the others */
+	turn int
+}
+
+func (t *zmqTransport) NewSubscriber() (Subscriber, error) {
+	s := &zmqSubscriber{
+		t: t,
+		poller: zmq4.NewPoller(),
+		socks: make(map[string]*zmq4.Socket),
+		addrs: make(map[*zmq4.Socket]string),
+		prefixes: make(map[string]bool),
+	}
+	return s, nil
+}
+
+func (s *zmqSubscriber) Connect(addr string) error {
+	if _, found := s.socks[addr]; found {
+		return nil
+	}
+	sock, err := zmq4.NewSocket(zmq4.SUB)
+	if err != nil {
+		return err
+	}
+	sock.SetLinger(0)
+	if err = s.t.client(sock, addr); err != nil {
+		sock.Close()
+		return err
+	}
+	for prefix := range s.prefixes {
+		sock.SetSubscribe(prefix)
+	}
+	if err = sock.Connect("tcp://" + addr); err != nil {
+		sock.Close()
+		return err
+	}
+	s.poller.Add(sock, zmq4.POLLIN)
+	s.socks[addr] = sock
+	s.addrs[sock] = addr
+	return nil
+}
+
+func (s *zmqSubscriber) Disconnect(addr string) error {
+	sock, found := s.socks[addr]
+	if !found {
+		return nil
+	}
+	s.poller.RemoveBySocket(sock)
+	delete(s.socks, addr)
+	delete(s.addrs, sock)
+	return sock.Close()
+}
+
+func (s *zmqSubscriber) Subscribe(prefix []byte) error {
+	s.prefixes[string(prefix)] = true
+	for _, sock := range s.socks {
+		if err := sock.SetSubscribe(string(prefix)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *zmqSubscriber) Unsubscribe(prefix []byte) error {
+	delete(s.prefixes, string(prefix))
+	for _, sock := range s.socks {
+		if err := sock.SetUnsubscribe(string(prefix)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *zmqSubscriber) Recv(timeout time.Duration) ([]byte, string, error) {
+	if len(s.socks) == 0 {
+		/* nothing to poll, zmq would return right away */
+		time.Sleep(timeout)
+		return nil, "", ErrTimeout
+	}
+	ready, err := s.poller.Poll(timeout)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(ready) == 0 {
+		return nil, "", ErrTimeout
+	}
+	s.turn++
+	sock := ready[s.turn % len(ready)].Socket
+	data, err := sock.RecvBytes(zmq4.DONTWAIT)
+	if err != nil && isTimeout(err) {
+		return nil, "", ErrTimeout
+	}
+	return data, s.addrs[sock], err
+}
+
+func (s *zmqSubscriber) Close() error {
+	for addr := range s.socks {
+		s.Disconnect(addr)
+	}
+	return nil
+}
+
+/* reply */
+
+type zmqResponder struct {
+	sock *zmq4.Socket
+}
+
+func (t *zmqTransport) Respond(addr string) (Responder, error) {
+	sock, err := zmq4.NewSocket(zmq4.REP)
+	if err != nil {
+		return nil, err
+	}
+	if err = t.server(sock); err != nil {
+		return nil, err
+	}
+	if err = sock.Bind("tcp://" + addr); err != nil {
+		return nil, err
+	}
+	return &zmqResponder{sock}, nil
+}
+
+func (r *zmqResponder) Recv() ([]byte, string, error) {
+	data, metadata, err := r.sock.RecvWithMetadata(0, pubkeyProperty)
+	return []byte(data), metadata[pubkeyProperty], err
+}
+
+func (r *zmqResponder) Reply(data []byte) error {
+	_, err := r.sock.SendBytes(data, 0)
+	return err
+}
+
+func (r *zmqResponder) Close() error {
+	return r.sock.Close()
+}
+
+/* request, on a socket of its own so concurrent requests don't trip over each other */
+func (t *zmqTransport) Request(addr string, data []byte, timeout time.Duration) ([]byte, error) {
+	sock, err := zmq4.NewSocket(zmq4.REQ)
+	if err != nil {
+		return nil, err
+	}
+	defer sock.Close()
+	sock.SetLinger(0)
+	sock.SetRcvtimeo(timeout)
+
+	if err = t.client(sock, addr); err != nil {
+		return nil, err
+	}
+	if err = sock.Connect("tcp://" + addr); err != nil {
+		return nil, err
+	}
+	if _, err = sock.SendBytes(data, 0); err != nil {
+		return nil, err
+	}
+	reply, err := sock.RecvBytes(0)
+	if err != nil && isTimeout(err) {
+		return nil, ErrTimeout
+	}
+	return reply, err
+}
@@ -17,6 +17,7 @@ type ConfigFileEntry struct {
 	MountPoint string
 	Dbpath string
 	HostAddress Endpoint
+	PublicKey string	/* optional 7th column: curve public key of the replica */
 }
 
 var configFileStructure []ConfigFileEntry
@@ -31,6 +32,7 @@ func SetConfigFile(configfile string) {
 
 	reader := csv.NewReader(file)
 	reader.Comma = ','
+	reader.FieldsPerRecord = -1
 
 	lineNumber := 1
 	for {
@@ -38,14 +40,17 @@ func SetConfigFile(configfile string) {
 		if err == io.EOF {
 			break
 		}
-		if len(record) != 6 {
-			if record[0][0] != '#' {
-				panic(fmt.Sprintf("invalid configuration at line %d:%s", lineNumber, record))
-			}
+		if len(record[0]) > 0 && record[0][0] == '#' {
+			/* comment */
+		} else if len(record) != 6 && len(record) != 7 {
+			panic(fmt.Sprintf("invalid configuration at line %d:%s", lineNumber, record))
 		} else {
 			pid, _ := strconv.Atoi(record[1])
 			port, _ := strconv.Atoi(record[5])
-			c := ConfigFileEntry{record[0], pid, record[2], record[3], Endpoint{record[4], port}}
+			c := ConfigFileEntry{record[0], pid, record[2], record[3], Endpoint{record[4], port}, ""}
+			if len(record) == 7 {
+				c.PublicKey = record[6]
+			}
 			configFileStructure = append(configFileStructure, c)
 		}
 		lineNumber += 1
@@ -61,6 +66,12 @@ func ReadAllEndpoints() []Endpoint {
 	return endpoints
 }
 
+func ReadAllConfigEntries() []ConfigFileEntry {
+	entries := make([]ConfigFileEntry, len(configFileStructure))
+	copy(entries, configFileStructure)
+	return entries
+}
+
 func GetConfigDetailsFromName(ServerName string) (error, string, int, string, string, Endpoint) {
 	var searchBy string
 	var searchString string
@@ -1,6 +1,10 @@
 package util
 
-import "fmt"
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
 
 type Endpoint struct {
 	Ipaddr string
@@ -11,10 +15,28 @@ func (e Endpoint) String() string {
 	return fmt.Sprintf("%s:%d", e.Ipaddr, e.Port)
 }
 
+/* parses host:port */
+func ParseEndpoint(s string) (Endpoint, error) {
+	host, portstr, err := net.SplitHostPort(s)
+	if err != nil {
+		return Endpoint{}, err
+	}
+	port, err := strconv.Atoi(portstr)
+	if err != nil {
+		return Endpoint{}, err
+	}
+	return Endpoint{host, port}, nil
+}
+
 func (e Endpoint) Tcpformat() string {
 	return fmt.Sprintf("tcp://%s:%d", e.Ipaddr, e.Port)
 }
 
+/* the REP socket of a replica listens on the port after its PUB socket */
+func (e Endpoint) RepEndpoint() Endpoint {
+	return Endpoint{e.Ipaddr, e.Port + 1}
+}
+
 func (e Endpoint) RepTcpFormat() string {
-	return fmt.Sprintf("tcp://%s:%d", e.Ipaddr, e.Port + 1)
+	return e.RepEndpoint().Tcpformat()
 }
@@ -0,0 +1,172 @@
+package util
+
+import (
+	"os"
+	"fmt"
+	"sort"
+	"sync"
+	"errors"
+	"strings"
+	"context"
+	"log/slog"
+)
+
+/*
+=======================
+LOGGING
+=======================
+*/
+
+/*
+	Leveled, structured logging on top of log/slog. Every subsystem logs through its own
+	logger, whose level can be changed while running (SetLogLevels, gofsctl log). Records go to
+	stderr as text and, once SetLogFile is called, to a file as JSON too.
+*/
+
+const (
+	LOG_FUSE = "fuse"
+	LOG_FLUSHER = "flusher"
+	LOG_NETWORK = "network"
+	LOG_STORAGE = "storage"
+	LOG_MAIN = "main"
+)
+
+var Subsystems = []string{LOG_FUSE, LOG_FLUSHER, LOG_NETWORK, LOG_STORAGE, LOG_MAIN}
+
+var logging struct {
+	lock sync.Mutex
+	levels map[string]*slog.LevelVar
+	outputs []slog.Handler
+	file *os.File
+}
+
+func init() {
+	logging.levels = make(map[string]*slog.LevelVar)
+	for _, s := range Subsystems {
+		logging.levels[s] = new(slog.LevelVar)
+	}
+	logging.outputs = []slog.Handler{slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})}
+}
+
+/* the logger of a subsystem, one of Subsystems. its records carry the subsystem's name */
+func Logger(subsystem string) *slog.Logger {
+	logging.lock.Lock()
+	level, found := logging.levels[subsystem]
+	logging.lock.Unlock()
+	if !found {
+		panic("no logging subsystem " + subsystem)
+	}
+	return slog.New(&logHandler{level, nil}).With("subsystem", subsystem)
+}
+
+/*
+	Sets levels from a spec like "info" (every subsystem) or "warn,network=debug,fuse=debug".
+	Levels are debug, info, warn and error.
+*/
+func SetLogLevels(spec string) error {
+	logging.lock.Lock()
+	defer logging.lock.Unlock()
+	for _, field := range strings.Split(spec, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		subsystem, name, scoped := strings.Cut(field, "=")
+		if !scoped {
+			subsystem, name = "", field
+		}
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(name)); err != nil {
+			return fmt.Errorf("bad log level %q", name)
+		}
+		if !scoped {
+			for _, v := range logging.levels {
+				v.Set(level)
+			}
+		} else if v, found := logging.levels[subsystem]; found {
+			v.Set(level)
+		} else {
+			return fmt.Errorf("no logging subsystem %q, there are %v", subsystem, Subsystems)
+		}
+	}
+	return nil
+}
+
+/* the current level of every subsystem, as subsystem=level, sorted */
+func LogLevels() []string {
+	logging.lock.Lock()
+	defer logging.lock.Unlock()
+	levels := []string{}
+	for s, v := range logging.levels {
+		levels = append(levels, s + "=" + strings.ToLower(v.Level().String()))
+	}
+	sort.Strings(levels)
+	return levels
+}
+
+/* also writes every record as JSON to the file at path (appending), or stops if path is empty */
+func SetLogFile(path string) error {
+	logging.lock.Lock()
+	defer logging.lock.Unlock()
+	if logging.file != nil {
+		logging.file.Close()
+		logging.file = nil
+	}
+	logging.outputs = logging.outputs[:1]
+	if path == "" {
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	logging.file = f
+	logging.outputs = append(logging.outputs, slog.NewJSONHandler(f, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	return nil
+}
+
+/*
+	Filters by the subsystem's level, then hands the record to every output. The outputs can
+	change at any time, so attributes and groups added to a logger are kept as steps and
+	replayed on the outputs of the moment.
+*/
+type logHandler struct {
+	level *slog.LevelVar
+	steps []func(slog.Handler) slog.Handler
+}
+
+func (h *logHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *logHandler) Handle(ctx context.Context, r slog.Record) error {
+	logging.lock.Lock()
+	outputs := append([]slog.Handler{}, logging.outputs...)
+	logging.lock.Unlock()
+
+	var errs []error
+	for _, out := range outputs {
+		for _, step := range h.steps {
+			out = step(out)
+		}
+		errs = append(errs, out.Handle(ctx, r.Clone()))
+	}
+	return errors.Join(errs...)
+}
+
+func (h *logHandler) with(step func(slog.Handler) slog.Handler) *logHandler {
+	steps := append(append([]func(slog.Handler) slog.Handler{}, h.steps...), step)
+	return &logHandler{h.level, steps}
+}
+
+func (h *logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return h.with(func(out slog.Handler) slog.Handler {
+		return out.WithAttrs(attrs)
+	})
+}
+
+func (h *logHandler) WithGroup(name string) slog.Handler {
+	return h.with(func(out slog.Handler) slog.Handler {
+		return out.WithGroup(name)
+	})
+}